@@ -23,42 +23,203 @@ var (
 
 type Config struct {
 	Server struct {
-		Host                                 string `yaml:"listen_host"`
-		Port                                 int    `yaml:"listen_port"`
-		MaxConnections                       int    `yaml:"max_connections"`
-		MaxConnectionsPerSecond              int    `yaml:"max_connections_per_second"`
-		MaxConnectionsPerSessionToken        int    `yaml:"max_connections_per_session_token"`
-		MaxConnectionQueriesPerMinute        int    `yaml:"max_connection_queries_per_minute"`
-		MaxConnectionMutationsPerMinute      int    `yaml:"max_connection_mutations_per_minute"`
-		MaxConnectionConcurrentSubscriptions int    `yaml:"max_connection_concurrent_subscriptions"`
-		MaxQueryLength                       int    `yaml:"max_query_length"`
-		MaxQueryDepth                        int    `yaml:"max_query_depth"`
-		MaxMutationLength                    int    `yaml:"max_mutation_length"`
-		AuthorizedCrossOrigin                string `yaml:"authorized_cross_origin"`
-		JsonPatchDisabled                    bool   `yaml:"json_patch_disabled"`
-		SubscriptionAllowedList              string `yaml:"subscriptions_allowed_list"`
-		SubscriptionsDeniedList              string `yaml:"subscriptions_denied_list"`
-		WebsocketIdleTimeoutSeconds          int    `yaml:"websocket_idle_timeout_seconds"`
+		Host                                 string                     `yaml:"listen_host"`
+		Port                                 int                        `yaml:"listen_port"`
+		MaxConnections                       int                        `yaml:"max_connections"`
+		MaxConnectionsPerSecond              int                        `yaml:"max_connections_per_second"`
+		MaxConnectionsPerSessionToken        int                        `yaml:"max_connections_per_session_token"`
+		MaxConnectionQueriesPerMinute        int                        `yaml:"max_connection_queries_per_minute"`
+		MaxConnectionMutationsPerMinute      int                        `yaml:"max_connection_mutations_per_minute"`
+		MaxConnectionConcurrentSubscriptions int                        `yaml:"max_connection_concurrent_subscriptions"`
+		MaxQueryLength                       int                        `yaml:"max_query_length"`
+		MaxQueryDepth                        int                        `yaml:"max_query_depth"`
+		MaxMutationLength                    int                        `yaml:"max_mutation_length"`
+		AuthorizedCrossOrigin                string                     `yaml:"authorized_cross_origin"`
+		AuthorizedCrossOrigins               []OriginPolicy             `yaml:"authorized_cross_origins"`
+		JsonPatchDisabled                    bool                       `yaml:"json_patch_disabled"`
+		MsgpackSubprotocolDisabled           bool                       `yaml:"msgpack_subprotocol_disabled"`
+		JsonPatchIdFields                    map[string]string          `yaml:"json_patch_id_fields"`
+		PatchVerification                    PatchVerificationConfig    `yaml:"patch_verification"`
+		PatchThresholds                      map[string]PatchThreshold  `yaml:"patch_thresholds"`
+		SubscriptionAllowedList              string                     `yaml:"subscriptions_allowed_list"`
+		SubscriptionsDeniedList              string                     `yaml:"subscriptions_denied_list"`
+		WebsocketIdleTimeoutSeconds          int                        `yaml:"websocket_idle_timeout_seconds"`
+		OperationPolicies                    map[string]OperationPolicy `yaml:"operation_policies"`
+		Compression                          WebsocketCompressionConfig `yaml:"compression"`
 	} `yaml:"server"`
 	Redis struct {
-		Host     string `yaml:"host"`
-		Port     int32  `yaml:"port"`
-		Password string `yaml:"password"`
+		Host                       string `yaml:"host"`
+		Port                       int32  `yaml:"port"`
+		Password                   string `yaml:"password"`
+		DistributedLimitsEnabled   bool   `yaml:"distributed_limits_enabled"`
+		DistributedLimitsKeyPrefix string `yaml:"distributed_limits_key_prefix"`
 	} `yaml:"redis"`
 	Hasura struct {
-		Url string `yaml:"url"`
+		Url         string                     `yaml:"url"`
+		Compression WebsocketCompressionConfig `yaml:"compression"`
 	} `yaml:"hasura"`
 	GraphqlActions struct {
-		Url string `yaml:"url"`
+		Url               string                         `yaml:"url"`
+		MaxRetries        int                            `yaml:"max_retries"`
+		RetryBackoffMs    int                            `yaml:"retry_backoff_ms"`
+		RetryMaxBackoffMs int                            `yaml:"retry_max_backoff_ms"`
+		CoalescingRules   map[string]CoalescingRule      `yaml:"coalescing_rules"`
+		PriorityLanes     map[string]PriorityLane        `yaml:"priority_lanes"`
+		Transport         string                         `yaml:"transport"`
+		Interceptors      map[string][]InterceptorConfig `yaml:"interceptors"`
+		MutationRoutes    map[string]string              `yaml:"mutation_routes"`
+		DedupeWindows     map[string]int                 `yaml:"dedupe_windows"`
+		RedisStreams      struct {
+			RequestStream     string `yaml:"request_stream"`
+			ReplyStreamPrefix string `yaml:"reply_stream_prefix"`
+			MaxLen            int64  `yaml:"max_len"`
+			TimeoutMs         int    `yaml:"timeout_ms"`
+		} `yaml:"redis_streams"`
 	} `yaml:"graphql-actions"`
 	AuthHook struct {
-		Url string `yaml:"url"`
+		Url             string `yaml:"url"`
+		CacheTtlSeconds int    `yaml:"cache_ttl_seconds"`
 	} `yaml:"auth_hook"`
+	AuthJwt struct {
+		Enabled                   bool     `yaml:"enabled"`
+		Header                    string   `yaml:"header"`
+		Algorithms                []string `yaml:"algorithms"`
+		HmacSecret                string   `yaml:"hmac_secret"`
+		PublicKeyFile             string   `yaml:"public_key_file"`
+		JwksFile                  string   `yaml:"jwks_file"`
+		Issuer                    string   `yaml:"issuer"`
+		Audience                  string   `yaml:"audience"`
+		ClaimsNamespace           string   `yaml:"claims_namespace"`
+		MeetingIdClaim            string   `yaml:"meeting_id_claim"`
+		UserIdClaim               string   `yaml:"user_id_claim"`
+		LeewaySeconds             int      `yaml:"leeway_seconds"`
+		FallbackToHooks           bool     `yaml:"fallback_to_hooks"`
+		SessionTokenClaimOptional bool     `yaml:"session_token_claim_optional"`
+	} `yaml:"auth_jwt"`
 	SessionVarsHook struct {
-		Url string `yaml:"url"`
+		Url             string `yaml:"url"`
+		CacheTtlSeconds int    `yaml:"cache_ttl_seconds"`
 	} `yaml:"session_vars_hook"`
-	LogLevel                         string `yaml:"log_level"`
-	PrometheusAdvancedMetricsEnabled bool   `yaml:"prometheus_advanced_metrics_enabled"`
+	HttpClient struct {
+		HttpClientConfig `yaml:",inline"`
+		Upstreams        map[string]HttpClientUpstreamConfig `yaml:"upstreams"`
+	} `yaml:"http_client"`
+	Audit struct {
+		Enabled          bool     `yaml:"enabled"`
+		Actions          []string `yaml:"actions"`
+		Sink             string   `yaml:"sink"`
+		BufferSize       int      `yaml:"buffer_size"`
+		RedactedInputs   []string `yaml:"redacted_inputs"`
+		MaxInputLength   int      `yaml:"max_input_length"`
+		SessionVariables []string `yaml:"session_variables"`
+		File             struct {
+			Path      string `yaml:"path"`
+			MaxSizeMb int    `yaml:"max_size_mb"`
+			MaxFiles  int    `yaml:"max_files"`
+		} `yaml:"file"`
+		RedisStream struct {
+			Stream string `yaml:"stream"`
+			MaxLen int64  `yaml:"max_len"`
+		} `yaml:"redis_stream"`
+	} `yaml:"audit"`
+	Caches                           map[string]CacheConfig `yaml:"caches"`
+	LogLevel                         string                 `yaml:"log_level"`
+	PrometheusAdvancedMetricsEnabled bool                   `yaml:"prometheus_advanced_metrics_enabled"`
+}
+
+// OperationPolicy overrides the connection limits for a given operation (query/subscription) or action (mutation)
+type OperationPolicy struct {
+	RatePerMinute int `yaml:"rate_per_minute"`
+	Burst         int `yaml:"burst"`
+	MaxLength     int `yaml:"max_length"`
+	MaxDepth      int `yaml:"max_depth"`
+}
+
+// CoalescingRule defines how the mutations of an action received within window_ms are merged into a single request
+type CoalescingRule struct {
+	Mode         string `yaml:"mode"` // latest_wins or batch
+	WindowMs     int    `yaml:"window_ms"`
+	MaxBatchSize int    `yaml:"max_batch_size"`
+}
+
+// PriorityLane lists the actions of a priority lane (control, interactive or bulk) and its limits
+type PriorityLane struct {
+	Actions            []string `yaml:"actions"`
+	MutationsPerMinute int      `yaml:"mutations_per_minute"`
+	BufferSize         int      `yaml:"buffer_size"`
+}
+
+// InterceptorConfig enables a mutation interceptor (trace_log, required_inputs, session_variables_inputs, reject or static_response)
+type InterceptorConfig struct {
+	Name    string                 `yaml:"name"`
+	Options map[string]interface{} `yaml:"options"`
+}
+
+// OriginPolicy authorizes a cross origin (pattern matched against the Origin host, or scheme://host)
+// and optionally restricts the connections coming from it
+type OriginPolicy struct {
+	Pattern            string   `yaml:"pattern"`
+	MaxConnections     int      `yaml:"max_connections"`
+	AllowedClientTypes []string `yaml:"allowed_client_types"`
+}
+
+// HttpClientConfig contains the settings of the outbound HTTP client (hooks and graphql-actions)
+type HttpClientConfig struct {
+	TimeoutMs               int    `yaml:"timeout_ms"`
+	ConnectTimeoutMs        int    `yaml:"connect_timeout_ms"`
+	ResponseHeaderTimeoutMs int    `yaml:"response_header_timeout_ms"`
+	IdleConnTimeoutSeconds  int    `yaml:"idle_conn_timeout_seconds"`
+	MaxIdleConns            int    `yaml:"max_idle_conns"`
+	MaxIdleConnsPerHost     int    `yaml:"max_idle_conns_per_host"`
+	MaxConnsPerHost         int    `yaml:"max_conns_per_host"`
+	ProxyUrl                string `yaml:"proxy_url"`
+	UnixSocket              string `yaml:"unix_socket"`
+	TlsCaFile               string `yaml:"tls_ca_file"`
+	TlsCertFile             string `yaml:"tls_cert_file"`
+	TlsKeyFile              string `yaml:"tls_key_file"`
+	TlsInsecureSkipVerify   bool   `yaml:"tls_insecure_skip_verify"`
+}
+
+// HttpClientUpstreamConfig overrides the settings of HttpClientConfig for an upstream, the fields not set (nil) are kept
+type HttpClientUpstreamConfig struct {
+	TimeoutMs               *int    `yaml:"timeout_ms"`
+	ConnectTimeoutMs        *int    `yaml:"connect_timeout_ms"`
+	ResponseHeaderTimeoutMs *int    `yaml:"response_header_timeout_ms"`
+	IdleConnTimeoutSeconds  *int    `yaml:"idle_conn_timeout_seconds"`
+	MaxIdleConns            *int    `yaml:"max_idle_conns"`
+	MaxIdleConnsPerHost     *int    `yaml:"max_idle_conns_per_host"`
+	MaxConnsPerHost         *int    `yaml:"max_conns_per_host"`
+	ProxyUrl                *string `yaml:"proxy_url"`
+	UnixSocket              *string `yaml:"unix_socket"`
+	TlsCaFile               *string `yaml:"tls_ca_file"`
+	TlsCertFile             *string `yaml:"tls_cert_file"`
+	TlsKeyFile              *string `yaml:"tls_key_file"`
+	TlsInsecureSkipVerify   *bool   `yaml:"tls_insecure_skip_verify"`
+}
+
+// WebsocketCompressionConfig defines the permessage-deflate compression of a websocket connection
+type WebsocketCompressionConfig struct {
+	Mode      string `yaml:"mode"`      // disabled, context_takeover or no_context_takeover
+	Threshold int    `yaml:"threshold"` // minimum size (bytes) of the compressed messages, 0 for the default of the mode
+}
+
+// PatchThreshold defines when the changes of an operation are sent as a patch instead of the full data
+type PatchThreshold struct {
+	Disabled     bool    `yaml:"disabled"`
+	MinLength    int     `yaml:"min_length"`     // data smaller than it (chars) is sent in full
+	MaxSizeRatio float64 `yaml:"max_size_ratio"` // the patch is sent only when smaller than this ratio of the data
+}
+
+// PatchVerificationConfig defines the sampling of the patches verified before being sent to the browser
+type PatchVerificationConfig struct {
+	SampleRate     float64 `yaml:"sample_rate"`      // 0 (disabled) to 1 (every patch)
+	FallbackToFull bool    `yaml:"fallback_to_full"` // send the full data when the patch doesn't recreate it
+}
+
+// CacheConfig defines the limits of a cache shared by all connections (hasura_message, patched_message, stream_cursor_value)
+type CacheConfig struct {
+	TtlSeconds int `yaml:"ttl_seconds"`
+	MaxSizeMb  int `yaml:"max_size_mb"`
 }
 
 func GetConfig() *Config {
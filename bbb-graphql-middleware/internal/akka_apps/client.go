@@ -2,12 +2,18 @@ package akka_apps
 
 import (
 	"bbb-graphql-middleware/config"
+	"bbb-graphql-middleware/internal/common"
+	"bbb-graphql-middleware/internal/httpclient"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 	"io/ioutil"
+	"maps"
 	"net/http"
 	"strings"
+	"time"
 )
 
 var sessionVarsHookUrl = config.GetConfig().SessionVarsHook.Url
@@ -15,18 +21,72 @@ var sessionVarsHookUrl = config.GetConfig().SessionVarsHook.Url
 var internalError = fmt.Errorf("server internal error")
 var internalErrorId = "internal_error"
 
+type sessionVariablesResult struct {
+	sessionVariables map[string]string
+	errorId          string
+}
+
+// Successful responses are cached by sessionToken+clientSessionUUID and concurrent requests are deduplicated.
+// Responses fetched while their sessionToken or meeting is invalidated are not cached.
+var (
+	sessionVariablesCache        = common.NewTtlCache[map[string]string](time.Duration(config.GetConfig().SessionVarsHook.CacheTtlSeconds) * time.Second)
+	sessionVariablesSingleFlight = common.NewSingleFlight[sessionVariablesResult]()
+	sessionVariablesGenerations  = common.NewCacheGenerations()
+)
+
 func AkkaAppsGetSessionVariablesFrom(browserConnectionId string, sessionToken string, clientSessionUUID string) (map[string]string, error, string) {
 	logger := log.WithField("_routine", "AkkaAppsClient").
 		WithField("browserConnectionId", browserConnectionId).
 		WithField("sessionToken", sessionToken).
 		WithField("clientSessionUUID", clientSessionUUID)
 
+	cacheKey := sessionToken + ":" + clientSessionUUID
+	if cachedSessionVariables, exists := sessionVariablesCache.Get(cacheKey); exists {
+		logger.Trace("Session variables obtained from cache")
+		common.HooksCacheCounter.With(prometheus.Labels{"hook": "session_vars", "result": "hit"}).Inc()
+		return maps.Clone(cachedSessionVariables), nil, ""
+	}
+
+	result, err, shared := sessionVariablesSingleFlight.Do(cacheKey, func() (sessionVariablesResult, error) {
+		generation := sessionVariablesGenerations.StartFetch()
+		sessionVariables, err, errorId := getSessionVariables(logger, sessionToken)
+		canStore := sessionVariablesGenerations.FinishFetch(generation,
+			"sessionToken:"+sessionToken, "meeting:"+sessionVariables["x-hasura-meetingid"])
+		if err == nil && canStore {
+			sessionVariablesCache.Store(cacheKey, sessionVariables)
+		}
+		return sessionVariablesResult{sessionVariables: sessionVariables, errorId: errorId}, err
+	})
+
+	if shared {
+		common.HooksCacheCounter.With(prometheus.Labels{"hook": "session_vars", "result": "shared"}).Inc()
+	} else {
+		common.HooksCacheCounter.With(prometheus.Labels{"hook": "session_vars", "result": "miss"}).Inc()
+	}
+
+	return maps.Clone(result.sessionVariables), err, result.errorId
+}
+
+// InvalidateSessionVariablesCache removes the cached session variables of the sessionToken
+func InvalidateSessionVariablesCache(sessionToken string) {
+	sessionVariablesGenerations.Invalidate("sessionToken:" + sessionToken)
+	sessionVariablesCache.DeleteFunc(func(key string, _ map[string]string) bool {
+		return strings.HasPrefix(key, sessionToken+":")
+	})
+}
+
+// InvalidateMeetingSessionVariablesCache removes the cached session variables of all users of the meeting
+func InvalidateMeetingSessionVariablesCache(meetingId string) {
+	sessionVariablesGenerations.Invalidate("meeting:" + meetingId)
+	sessionVariablesCache.DeleteFunc(func(_ string, sessionVariables map[string]string) bool {
+		return sessionVariables["x-hasura-meetingid"] == meetingId
+	})
+}
+
+func getSessionVariables(logger *log.Entry, sessionToken string) (map[string]string, error, string) {
 	logger.Debug("Starting AkkaAppsClient")
 	defer logger.Debug("Finished AkkaAppsClient")
 
-	// Create a new HTTP client with a cookie jar.
-	client := &http.Client{}
-
 	// Check if the session_vars hook URL is set.
 	if sessionVarsHookUrl == "" {
 		log.Error("Config session_vars_hook.url not set")
@@ -45,7 +105,7 @@ func AkkaAppsGetSessionVariablesFrom(browserConnectionId string, sessionToken st
 	// Execute the HTTP request to obtain user session variables (like X-Hasura-Role)
 	req.Header.Set("x-session-token", sessionToken)
 	req.Header.Set("User-Agent", "bbb-graphql-middleware")
-	resp, err := client.Do(req)
+	resp, err := httpclient.Get(httpclient.SessionVarsHook).Do(req)
 	if err != nil {
 		return nil, internalError, internalErrorId
 	}
@@ -71,7 +131,7 @@ func AkkaAppsGetSessionVariablesFrom(browserConnectionId string, sessionToken st
 	}
 	if response != "authorized" {
 		logger.Errorf("not authorized: Response: %s, Message: %s, MessageId: %s", response, message, messageId)
-		return nil, fmt.Errorf(message), messageId
+		return nil, errors.New(message), messageId
 	}
 
 	// Normalize the response header keys.
@@ -0,0 +1,29 @@
+package akka_apps
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// The meeting of the session variables (x-hasura-meetingid) is invalidated while they are fetched
+func TestSessionVariablesOfMeetingInvalidatedDuringFetchAreNotCached(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		InvalidateMeetingSessionVariablesCache("meeting-1")
+		_, _ = w.Write([]byte(`{"response":"authorized","X-Hasura-MeetingId":"meeting-1","X-Hasura-UserId":"user-1"}`))
+	}))
+	defer server.Close()
+	sessionVarsHookUrl = server.URL
+
+	sessionVariables, err, _ := AkkaAppsGetSessionVariablesFrom("conn-1", "token", "client-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sessionVariables["x-hasura-meetingid"] != "meeting-1" {
+		t.Fatalf("unexpected session variables: %v", sessionVariables)
+	}
+
+	if _, cached := sessionVariablesCache.Get("token:client-1"); cached {
+		t.Error("session variables cached after the invalidation of their meeting")
+	}
+}
@@ -0,0 +1,163 @@
+package audit
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"bbb-graphql-middleware/config"
+	"bbb-graphql-middleware/internal/common"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// Outcomes of an audited mutation
+const (
+	OutcomeSuccess   = "success"
+	OutcomeError     = "error"
+	OutcomeRejected  = "rejected"  // rejected by the middleware (limits or interceptors)
+	OutcomeResponded = "responded" // answered by an interceptor, without being sent
+	OutcomeForwarded = "forwarded" // sent to Hasura, that answers the client directly
+)
+
+var auditConfig = config.GetConfig().Audit
+
+// Record is a line of the audit log
+type Record struct {
+	Time                time.Time              `json:"time"`
+	Action              string                 `json:"action"`
+	OperationName       string                 `json:"operationName,omitempty"`
+	Upstream            string                 `json:"upstream"`
+	Inputs              map[string]interface{} `json:"inputs,omitempty"`
+	MeetingId           string                 `json:"meetingId"`
+	UserId              string                 `json:"userId"`
+	SessionVariables    map[string]string      `json:"sessionVariables,omitempty"`
+	BrowserConnectionId string                 `json:"browserConnectionId"`
+	Outcome             string                 `json:"outcome"`
+	StatusCode          int                    `json:"statusCode,omitempty"`
+	DurationMs          int64                  `json:"durationMs"`
+	Error               string                 `json:"error,omitempty"`
+}
+
+// Sink writes the audit records (rotating JSON-lines file or Redis stream)
+type Sink interface {
+	Write(record Record) error
+}
+
+var (
+	auditedActions = getAuditedActions()
+	recordsChannel chan Record
+	startOnce      sync.Once
+)
+
+func getAuditedActions() map[string]bool {
+	actions := make(map[string]bool, len(auditConfig.Actions))
+	for _, actionName := range auditConfig.Actions {
+		actions[actionName] = true
+	}
+	return actions
+}
+
+// IsAudited returns whether the mutations of the action must be recorded (all actions when config audit.actions is empty)
+func IsAudited(actionName string) bool {
+	if !auditConfig.Enabled {
+		return false
+	}
+	return len(auditedActions) == 0 || auditedActions[actionName]
+}
+
+// Write queues the record to be written by the sink, records are dropped (and counted) when the queue is full
+func Write(record Record) {
+	startOnce.Do(start)
+
+	if recordsChannel == nil {
+		return
+	}
+
+	record.Inputs = sanitizeInputs(record.Inputs)
+	record.SessionVariables = filterSessionVariables(record.SessionVariables)
+
+	select {
+	case recordsChannel <- record:
+	default:
+		common.AuditRecordsCounter.With(prometheus.Labels{"result": "dropped"}).Inc()
+	}
+}
+
+func start() {
+	logger := log.WithField("_routine", "AuditWriter")
+
+	sink, err := newSink()
+	if err != nil {
+		logger.Errorf("Error while creating the audit sink %s, audit disabled: %v", auditConfig.Sink, err)
+		return
+	}
+
+	bufferSize := auditConfig.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = 1000
+	}
+	recordsChannel = make(chan Record, bufferSize)
+
+	go func() {
+		for record := range recordsChannel {
+			if err := sink.Write(record); err != nil {
+				logger.Errorf("Error while writing audit record: %v", err)
+				common.AuditRecordsCounter.With(prometheus.Labels{"result": "failed"}).Inc()
+				continue
+			}
+			common.AuditRecordsCounter.With(prometheus.Labels{"result": "written"}).Inc()
+		}
+	}()
+}
+
+// sanitizeInputs redacts the inputs listed in config audit.redacted_inputs and truncates long strings
+func sanitizeInputs(inputs map[string]interface{}) map[string]interface{} {
+	if inputs == nil {
+		return nil
+	}
+
+	sanitized := make(map[string]interface{}, len(inputs))
+	for key, value := range inputs {
+		sanitized[key] = sanitizeValue(key, value)
+	}
+	return sanitized
+}
+
+func sanitizeValue(key string, value interface{}) interface{} {
+	for _, redactedInput := range auditConfig.RedactedInputs {
+		if strings.EqualFold(key, redactedInput) {
+			return "[REDACTED]"
+		}
+	}
+
+	switch v := value.(type) {
+	case string:
+		if auditConfig.MaxInputLength > 0 && len(v) > auditConfig.MaxInputLength {
+			return v[:auditConfig.MaxInputLength] + "...[TRUNCATED]"
+		}
+		return v
+	case map[string]interface{}:
+		return sanitizeInputs(v)
+	case []interface{}:
+		sanitizedList := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			sanitizedList = append(sanitizedList, sanitizeValue("", item))
+		}
+		return sanitizedList
+	default:
+		return v
+	}
+}
+
+// filterSessionVariables keeps only the session variables listed in config audit.session_variables
+func filterSessionVariables(sessionVariables map[string]string) map[string]string {
+	filtered := make(map[string]string, len(auditConfig.SessionVariables))
+	for _, sessionVariable := range auditConfig.SessionVariables {
+		if value, exists := sessionVariables[strings.ToLower(sessionVariable)]; exists {
+			filtered[strings.ToLower(sessionVariable)] = value
+		}
+	}
+	return filtered
+}
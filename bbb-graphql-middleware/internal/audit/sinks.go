@@ -0,0 +1,137 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"bbb-graphql-middleware/internal/common"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	SinkFile        = "file"
+	SinkRedisStream = "redis_stream"
+)
+
+func newSink() (Sink, error) {
+	switch auditConfig.Sink {
+	case "", SinkFile:
+		return newFileSink(auditConfig.File.Path, int64(auditConfig.File.MaxSizeMb)*1024*1024, auditConfig.File.MaxFiles)
+	case SinkRedisStream:
+		return &redisStreamSink{
+			redisClient: common.NewRedisClient(),
+			stream:      auditConfig.RedisStream.Stream,
+			maxLen:      auditConfig.RedisStream.MaxLen,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown sink")
+	}
+}
+
+// fileSink appends the records as JSON lines, rotating the file when it reaches maxSize (path.1, path.2, ...)
+type fileSink struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+func newFileSink(path string, maxSize int64, maxFiles int) (*fileSink, error) {
+	if path == "" {
+		return nil, fmt.Errorf("config audit.file.path not set")
+	}
+
+	sink := &fileSink{path: filepath.Clean(path), maxSize: maxSize, maxFiles: maxFiles}
+	if err := sink.open(); err != nil {
+		return nil, err
+	}
+	return sink, nil
+}
+
+func (s *fileSink) open() error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0750); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	s.file = file
+	s.size = fileInfo.Size()
+	return nil
+}
+
+func (s *fileSink) rotate() error {
+	s.file.Close()
+
+	for i := s.maxFiles - 1; i >= 1; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1))
+	}
+	if s.maxFiles > 0 {
+		_ = os.Rename(s.path, s.path+".1")
+	} else {
+		_ = os.Remove(s.path)
+	}
+
+	return s.open()
+}
+
+func (s *fileSink) Write(record Record) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if s.maxSize > 0 && s.size+int64(len(line)) > s.maxSize && s.size > 0 {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	written, err := s.file.Write(line)
+	s.size += int64(written)
+	return err
+}
+
+// redisStreamSink adds each record (field `record`, as JSON) to a Redis stream
+type redisStreamSink struct {
+	redisClient *redis.Client
+	stream      string
+	maxLen      int64
+}
+
+func (s *redisStreamSink) Write(record Record) error {
+	recordAsJson, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	return s.redisClient.XAdd(ctx, &redis.XAddArgs{
+		Stream: s.stream,
+		MaxLen: s.maxLen,
+		Approx: true,
+		Values: map[string]interface{}{
+			"action":    record.Action,
+			"meetingId": record.MeetingId,
+			"record":    recordAsJson,
+		},
+	}).Err()
+}
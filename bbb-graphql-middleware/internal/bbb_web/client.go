@@ -2,33 +2,101 @@ package bbb_web
 
 import (
 	"bbb-graphql-middleware/config"
+	"bbb-graphql-middleware/internal/common"
+	"bbb-graphql-middleware/internal/httpclient"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 	"io/ioutil"
 	"net/http"
-	"net/http/cookiejar"
+	"sort"
 	"strings"
+	"time"
 )
 
 // authHookUrl is the authentication hook URL obtained from config file.
 var authHookUrl = config.GetConfig().AuthHook.Url
 
+type authorization struct {
+	meetingId string
+	userId    string
+}
+
+// Successful authorizations are cached by sessionToken+clientSessionUUID+cookies and concurrent checks are deduplicated.
+// Authorizations checked while their sessionToken or meeting is invalidated are not cached.
+var (
+	authorizationCache        = common.NewTtlCache[authorization](time.Duration(config.GetConfig().AuthHook.CacheTtlSeconds) * time.Second)
+	authorizationSingleFlight = common.NewSingleFlight[authorization]()
+	authorizationGenerations  = common.NewCacheGenerations()
+)
+
 func BBBWebCheckAuthorization(browserConnectionId string, sessionToken string, clientSessionUUID string, cookies []*http.Cookie) (string, string, error) {
 	logger := log.WithField("_routine", "BBBWebClient").
 		WithField("browserConnectionId", browserConnectionId).
 		WithField("sessionToken", sessionToken).
 		WithField("clientSessionUUID", clientSessionUUID)
 
-	logger.Debug("Starting BBBWebClient")
-	defer logger.Debug("Finished BBBWebClient")
+	// The cookies are sent to the hook, so the result of other cookies is not reused
+	cacheKey := sessionToken + ":" + clientSessionUUID + ":" + getCookiesHash(cookies)
+	if cachedAuthorization, exists := authorizationCache.Get(cacheKey); exists {
+		logger.Trace("Authorization obtained from cache")
+		common.HooksCacheCounter.With(prometheus.Labels{"hook": "auth", "result": "hit"}).Inc()
+		return cachedAuthorization.meetingId, cachedAuthorization.userId, nil
+	}
 
-	// Create a new HTTP client with a cookie jar.
-	jar, err := cookiejar.New(nil)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to create cookie jar: %v", err)
+	result, err, shared := authorizationSingleFlight.Do(cacheKey, func() (authorization, error) {
+		generation := authorizationGenerations.StartFetch()
+		meetingId, userId, err := checkAuthorization(logger, sessionToken, cookies)
+		canStore := authorizationGenerations.FinishFetch(generation, "sessionToken:"+sessionToken, "meeting:"+meetingId)
+		if err == nil && meetingId != "" && userId != "" && canStore {
+			authorizationCache.Store(cacheKey, authorization{meetingId: meetingId, userId: userId})
+		}
+		return authorization{meetingId: meetingId, userId: userId}, err
+	})
+
+	if shared {
+		common.HooksCacheCounter.With(prometheus.Labels{"hook": "auth", "result": "shared"}).Inc()
+	} else {
+		common.HooksCacheCounter.With(prometheus.Labels{"hook": "auth", "result": "miss"}).Inc()
+	}
+
+	return result.meetingId, result.userId, err
+}
+
+// getCookiesHash returns a hash of the cookies, regardless of their order
+func getCookiesHash(cookies []*http.Cookie) string {
+	cookieValues := make([]string, 0, len(cookies))
+	for _, cookie := range cookies {
+		cookieValues = append(cookieValues, cookie.Name+"="+cookie.Value)
 	}
-	client := &http.Client{Jar: jar}
+	sort.Strings(cookieValues)
+
+	hash := sha256.Sum256([]byte(strings.Join(cookieValues, "; ")))
+	return hex.EncodeToString(hash[:])
+}
+
+// InvalidateAuthorizationCache removes the cached authorizations of the sessionToken
+func InvalidateAuthorizationCache(sessionToken string) {
+	authorizationGenerations.Invalidate("sessionToken:" + sessionToken)
+	authorizationCache.DeleteFunc(func(key string, _ authorization) bool {
+		return strings.HasPrefix(key, sessionToken+":")
+	})
+}
+
+// InvalidateMeetingAuthorizationCache removes the cached authorizations of all users of the meeting
+func InvalidateMeetingAuthorizationCache(meetingId string) {
+	authorizationGenerations.Invalidate("meeting:" + meetingId)
+	authorizationCache.DeleteFunc(func(_ string, value authorization) bool {
+		return value.meetingId == meetingId
+	})
+}
+
+func checkAuthorization(logger *log.Entry, sessionToken string, cookies []*http.Cookie) (string, string, error) {
+	logger.Debug("Starting BBBWebClient")
+	defer logger.Debug("Finished BBBWebClient")
 
 	// Check if the authentication hook URL is set.
 	if authHookUrl == "" {
@@ -50,7 +118,7 @@ func BBBWebCheckAuthorization(browserConnectionId string, sessionToken string, c
 	//req.Header.Set("x-original-uri", authHookUrl+"?sessionToken="+sessionToken)
 	req.Header.Set("x-session-token", sessionToken)
 	//req.Header.Set("User-Agent", "hasura-graphql-engine")
-	resp, err := client.Do(req)
+	resp, err := httpclient.Get(httpclient.AuthHook).Do(req)
 	if err != nil {
 		return "", "", err
 	}
@@ -91,7 +159,7 @@ func BBBWebCheckAuthorization(browserConnectionId string, sessionToken string, c
 
 	//Get userId and meetingId from response Header
 	for key, value := range normalizedResponse {
-		log.Debug("%s: %s\n", key, value)
+		log.Debugf("%s: %s", key, value)
 
 		if key == "x-userid" {
 			userId = value
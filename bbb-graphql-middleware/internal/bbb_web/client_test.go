@@ -0,0 +1,61 @@
+package bbb_web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestAuthorizationIsCachedByCookies(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if cookie, err := r.Cookie("JSESSIONID"); err != nil || cookie.Value != "valid" {
+			_, _ = w.Write([]byte(`{"response":"unauthorized"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"response":"authorized","X-MeetingId":"meeting-1","X-UserId":"user-1"}`))
+	}))
+	defer server.Close()
+	authHookUrl = server.URL
+	defer InvalidateAuthorizationCache("token")
+
+	validCookies := []*http.Cookie{{Name: "JSESSIONID", Value: "valid"}, {Name: "other", Value: "1"}}
+	if _, _, err := BBBWebCheckAuthorization("conn-1", "token", "client-1", validCookies); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The order of the cookies doesn't matter
+	reorderedCookies := []*http.Cookie{validCookies[1], validCookies[0]}
+	if _, _, err := BBBWebCheckAuthorization("conn-2", "token", "client-1", reorderedCookies); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if requests.Load() != 1 {
+		t.Errorf("requests = %d, expected the second authorization from cache", requests.Load())
+	}
+
+	// Other cookies are checked by the hook, instead of reusing the cached authorization
+	invalidCookies := []*http.Cookie{{Name: "JSESSIONID", Value: "invalid"}}
+	if _, _, err := BBBWebCheckAuthorization("conn-3", "token", "client-1", invalidCookies); err == nil {
+		t.Error("authorization of other cookies reused")
+	}
+}
+
+// The meeting of the authorization (x-meetingid) is invalidated while it's checked
+func TestAuthorizationOfMeetingInvalidatedDuringCheckIsNotCached(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		InvalidateMeetingAuthorizationCache("meeting-1")
+		_, _ = w.Write([]byte(`{"response":"authorized","X-MeetingId":"meeting-1","X-UserId":"user-1"}`))
+	}))
+	defer server.Close()
+	authHookUrl = server.URL
+
+	if _, _, err := BBBWebCheckAuthorization("conn-1", "token", "client-1", nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, cached := authorizationCache.Get("token:client-1:" + getCookiesHash(nil)); cached {
+		t.Error("authorization cached after the invalidation of its meeting")
+	}
+}
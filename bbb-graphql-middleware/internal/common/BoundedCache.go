@@ -0,0 +1,219 @@
+package common
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"bbb-graphql-middleware/config"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const defaultCacheTtl = 30 * time.Second
+
+// BoundedCache is a cache shared by all connections, whose entries are removed after the ttl
+// (by a single janitor routine) or, the least recently used ones, when it exceeds its size in bytes.
+// Each entry keeps the length of the data it was created from, that is verified before reusing it
+// (so a checksum collision is not able to return the entry of another message).
+type BoundedCache[K comparable, V any] struct {
+	name         string
+	ttl          time.Duration
+	maxSizeBytes int
+
+	entries      map[K]*boundedCacheEntry[K, V]
+	lruList      *list.List // most recently used at the front
+	expiryList   *list.List // first stored at the front
+	sizeBytes    int
+	entriesMutex sync.Mutex
+
+	// locks avoid that several routines load the same entry at the same time
+	locks *CacheLocks[K]
+
+	hitsCounter               prometheus.Counter
+	missesCounter             prometheus.Counter
+	expiredEvictionsCounter   prometheus.Counter
+	sizeLimitEvictionsCounter prometheus.Counter
+	sizeGauge                 prometheus.Gauge
+	entriesGauge              prometheus.Gauge
+}
+
+type boundedCacheEntry[K comparable, V any] struct {
+	key           K
+	value         V
+	sourceLength  int
+	sizeBytes     int
+	expiresAt     time.Time
+	lruElement    *list.Element
+	expiryElement *list.Element
+}
+
+// expirableCache is implemented by all the bounded caches, so a single janitor removes the expired entries of them
+type expirableCache interface {
+	removeExpired(now time.Time)
+}
+
+var (
+	boundedCaches      []expirableCache
+	boundedCachesMutex sync.Mutex
+	cacheJanitorOnce   sync.Once
+)
+
+// NewBoundedCache creates a cache using the limits of config caches.<name>
+func NewBoundedCache[K comparable, V any](name string) *BoundedCache[K, V] {
+	cacheConfig := config.GetConfig().Caches[name]
+
+	ttl := time.Duration(cacheConfig.TtlSeconds) * time.Second
+	if ttl <= 0 {
+		ttl = defaultCacheTtl
+	}
+
+	c := &BoundedCache[K, V]{
+		name:                      name,
+		ttl:                       ttl,
+		maxSizeBytes:              cacheConfig.MaxSizeMb * 1024 * 1024,
+		entries:                   make(map[K]*boundedCacheEntry[K, V]),
+		lruList:                   list.New(),
+		expiryList:                list.New(),
+		locks:                     NewCacheLocks[K](),
+		hitsCounter:               CacheHitsCounter.With(prometheus.Labels{"cache": name}),
+		missesCounter:             CacheMissesCounter.With(prometheus.Labels{"cache": name}),
+		expiredEvictionsCounter:   CacheEvictionsCounter.With(prometheus.Labels{"cache": name, "reason": "expired"}),
+		sizeLimitEvictionsCounter: CacheEvictionsCounter.With(prometheus.Labels{"cache": name, "reason": "size_limit"}),
+		sizeGauge:                 CacheSizeBytesGauge.With(prometheus.Labels{"cache": name}),
+		entriesGauge:              CacheEntriesGauge.With(prometheus.Labels{"cache": name}),
+	}
+
+	boundedCachesMutex.Lock()
+	boundedCaches = append(boundedCaches, c)
+	boundedCachesMutex.Unlock()
+
+	return c
+}
+
+// Get returns the value of the key, when it was created from data of the same length
+func (c *BoundedCache[K, V]) Get(key K, sourceLength int) (V, bool) {
+	value, exists := c.lookup(key, sourceLength)
+	if exists {
+		c.hitsCounter.Inc()
+	} else {
+		c.missesCounter.Inc()
+	}
+	return value, exists
+}
+
+// GetOrLoad returns the value of the key, or loads it (returning the value and its size in bytes) and stores it.
+// Routines requesting the same key wait for the first one to load it, to benefit from its cache.
+func (c *BoundedCache[K, V]) GetOrLoad(key K, sourceLength int, load func() (V, int)) V {
+	if value, exists := c.lookup(key, sourceLength); exists {
+		c.hitsCounter.Inc()
+		return value
+	}
+
+	c.locks.Lock(key)
+	defer c.locks.Unlock(key)
+
+	// Other routine could have loaded it while this one was waiting for the lock
+	if value, exists := c.lookup(key, sourceLength); exists {
+		c.hitsCounter.Inc()
+		return value
+	}
+
+	c.missesCounter.Inc()
+	value, sizeBytes := load()
+	c.Store(key, sourceLength, value, sizeBytes)
+	return value
+}
+
+// Store adds the value to the cache, evicting the least recently used entries when the cache exceeds its size
+func (c *BoundedCache[K, V]) Store(key K, sourceLength int, value V, sizeBytes int) {
+	cacheJanitorOnce.Do(func() {
+		go cacheJanitorRoutine()
+	})
+
+	c.entriesMutex.Lock()
+	defer c.entriesMutex.Unlock()
+
+	if existingEntry, exists := c.entries[key]; exists {
+		c.remove(existingEntry)
+	}
+
+	entry := &boundedCacheEntry[K, V]{
+		key:          key,
+		value:        value,
+		sourceLength: sourceLength,
+		sizeBytes:    sizeBytes,
+		expiresAt:    time.Now().Add(c.ttl),
+	}
+	entry.lruElement = c.lruList.PushFront(entry)
+	entry.expiryElement = c.expiryList.PushBack(entry)
+	c.entries[key] = entry
+	c.sizeBytes += sizeBytes
+
+	if c.maxSizeBytes > 0 {
+		for c.sizeBytes > c.maxSizeBytes && c.lruList.Len() > 0 {
+			c.remove(c.lruList.Back().Value.(*boundedCacheEntry[K, V]))
+			c.sizeLimitEvictionsCounter.Inc()
+		}
+	}
+
+	c.updateGauges()
+}
+
+func (c *BoundedCache[K, V]) lookup(key K, sourceLength int) (V, bool) {
+	c.entriesMutex.Lock()
+	defer c.entriesMutex.Unlock()
+
+	entry, exists := c.entries[key]
+	if !exists || entry.sourceLength != sourceLength || time.Now().After(entry.expiresAt) {
+		var zeroValue V
+		return zeroValue, false
+	}
+
+	c.lruList.MoveToFront(entry.lruElement)
+	return entry.value, true
+}
+
+// removeExpired removes the entries whose ttl is over (they are sorted by expiration in expiryList)
+func (c *BoundedCache[K, V]) removeExpired(now time.Time) {
+	c.entriesMutex.Lock()
+	defer c.entriesMutex.Unlock()
+
+	for c.expiryList.Len() > 0 {
+		entry := c.expiryList.Front().Value.(*boundedCacheEntry[K, V])
+		if entry.expiresAt.After(now) {
+			break
+		}
+		c.remove(entry)
+		c.expiredEvictionsCounter.Inc()
+	}
+
+	c.updateGauges()
+}
+
+func (c *BoundedCache[K, V]) remove(entry *boundedCacheEntry[K, V]) {
+	c.lruList.Remove(entry.lruElement)
+	c.expiryList.Remove(entry.expiryElement)
+	delete(c.entries, entry.key)
+	c.sizeBytes -= entry.sizeBytes
+}
+
+func (c *BoundedCache[K, V]) updateGauges() {
+	c.sizeGauge.Set(float64(c.sizeBytes))
+	c.entriesGauge.Set(float64(len(c.entries)))
+}
+
+func cacheJanitorRoutine() {
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		boundedCachesMutex.Lock()
+		caches := boundedCaches
+		boundedCachesMutex.Unlock()
+
+		for _, cache := range caches {
+			cache.removeExpired(now)
+		}
+	}
+}
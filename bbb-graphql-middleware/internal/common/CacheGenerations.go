@@ -0,0 +1,73 @@
+package common
+
+import (
+	"sync"
+)
+
+// CacheGenerations tracks the invalidations that happen while values are being fetched, so a value fetched before
+// an invalidation is not cached after it: the generation is read before the fetch, and the value is stored only
+// when none of its keys (e.g. the sessionToken and the meeting of the value) were invalidated in the meantime
+type CacheGenerations struct {
+	generation    uint64
+	inFlight      map[uint64]int    // Number of fetches in progress by the generation they started at
+	invalidatedAt map[string]uint64 // Generation of the last invalidation of each key, while there are fetches in progress
+	mutex         sync.Mutex
+}
+
+func NewCacheGenerations() *CacheGenerations {
+	return &CacheGenerations{
+		inFlight:      make(map[uint64]int),
+		invalidatedAt: make(map[string]uint64),
+	}
+}
+
+// StartFetch returns the current generation, that must be passed to FinishFetch when the fetch completes
+func (g *CacheGenerations) StartFetch() uint64 {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.inFlight[g.generation]++
+	return g.generation
+}
+
+// FinishFetch returns whether the value fetched can be stored, that is none of the keys was invalidated since startedAt
+func (g *CacheGenerations) FinishFetch(startedAt uint64, keys ...string) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	canStore := true
+	for _, key := range keys {
+		if g.invalidatedAt[key] > startedAt {
+			canStore = false
+		}
+	}
+
+	g.inFlight[startedAt]--
+	if g.inFlight[startedAt] == 0 {
+		delete(g.inFlight, startedAt)
+	}
+
+	// Invalidations older than all fetches in progress are not needed anymore
+	oldestInFlight := g.generation
+	for generation := range g.inFlight {
+		oldestInFlight = min(oldestInFlight, generation)
+	}
+	for key, generation := range g.invalidatedAt {
+		if generation <= oldestInFlight {
+			delete(g.invalidatedAt, key)
+		}
+	}
+
+	return canStore
+}
+
+// Invalidate prevents the values of the key being fetched from being stored
+func (g *CacheGenerations) Invalidate(key string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.generation++
+	if len(g.inFlight) > 0 {
+		g.invalidatedAt[key] = g.generation
+	}
+}
@@ -0,0 +1,111 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCacheGenerations(t *testing.T) {
+	tests := []struct {
+		name             string
+		beforeFetch      func(g *CacheGenerations)
+		duringFetch      func(g *CacheGenerations)
+		expectedCanStore bool
+	}{
+		{
+			name:             "no invalidation",
+			expectedCanStore: true,
+		},
+		{
+			name:             "key invalidated during the fetch",
+			duringFetch:      func(g *CacheGenerations) { g.Invalidate("sessionToken:token") },
+			expectedCanStore: false,
+		},
+		{
+			name:             "group invalidated during the fetch",
+			duringFetch:      func(g *CacheGenerations) { g.Invalidate("meeting:meeting-1") },
+			expectedCanStore: false,
+		},
+		{
+			name:             "other key invalidated during the fetch",
+			duringFetch:      func(g *CacheGenerations) { g.Invalidate("sessionToken:other") },
+			expectedCanStore: true,
+		},
+		{
+			name:             "key invalidated before the fetch",
+			beforeFetch:      func(g *CacheGenerations) { g.Invalidate("sessionToken:token") },
+			expectedCanStore: true,
+		},
+		{
+			name: "key invalidated during another fetch that started before",
+			beforeFetch: func(g *CacheGenerations) {
+				g.StartFetch()
+				g.Invalidate("sessionToken:token")
+			},
+			expectedCanStore: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			generations := NewCacheGenerations()
+			if tt.beforeFetch != nil {
+				tt.beforeFetch(generations)
+			}
+
+			generation := generations.StartFetch()
+			if tt.duringFetch != nil {
+				tt.duringFetch(generations)
+			}
+
+			if canStore := generations.FinishFetch(generation, "sessionToken:token", "meeting:meeting-1"); canStore != tt.expectedCanStore {
+				t.Errorf("canStore = %v, expected %v", canStore, tt.expectedCanStore)
+			}
+		})
+	}
+}
+
+func TestCacheGenerationsDiscardsInvalidationsWithoutFetchesInProgress(t *testing.T) {
+	generations := NewCacheGenerations()
+
+	generations.Invalidate("sessionToken:token")
+	if len(generations.invalidatedAt) != 0 {
+		t.Errorf("invalidation recorded without fetches in progress: %v", generations.invalidatedAt)
+	}
+
+	generation := generations.StartFetch()
+	generations.Invalidate("sessionToken:token")
+	generations.FinishFetch(generation, "sessionToken:token")
+	if len(generations.invalidatedAt) != 0 || len(generations.inFlight) != 0 {
+		t.Errorf("state kept after the fetches completed: %v %v", generations.invalidatedAt, generations.inFlight)
+	}
+}
+
+func TestTtlCache(t *testing.T) {
+	cache := NewTtlCache[string](50 * time.Millisecond)
+	cache.Store("token:1", "meeting-1")
+	cache.Store("token:2", "meeting-2")
+
+	if value, exists := cache.Get("token:1"); !exists || value != "meeting-1" {
+		t.Errorf("Get = %q %v, expected the value stored", value, exists)
+	}
+
+	cache.DeleteFunc(func(_ string, value string) bool { return value == "meeting-1" })
+	if _, exists := cache.Get("token:1"); exists {
+		t.Error("entry not removed by DeleteFunc")
+	}
+	if _, exists := cache.Get("token:2"); !exists {
+		t.Error("entry removed by DeleteFunc without matching")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if _, exists := cache.Get("token:2"); exists {
+		t.Error("expired entry returned")
+	}
+
+	disabledCache := NewTtlCache[string](0)
+	disabledCache.Store("token:1", "meeting-1")
+	if _, exists := disabledCache.Get("token:1"); exists {
+		t.Error("entry stored in disabled cache")
+	}
+}
@@ -4,25 +4,23 @@ import (
 	"sync"
 )
 
-var GlobalCacheLocks = NewCacheLocks()
-
 type refMutex struct {
 	mutex    *sync.Mutex
 	refCount int
 }
 
-type CacheLocks struct {
-	locks map[uint32]*refMutex
+type CacheLocks[K comparable] struct {
+	locks map[K]*refMutex
 	mutex sync.Mutex // Protects the 'locks' map
 }
 
-func NewCacheLocks() *CacheLocks {
-	return &CacheLocks{
-		locks: make(map[uint32]*refMutex),
+func NewCacheLocks[K comparable]() *CacheLocks[K] {
+	return &CacheLocks[K]{
+		locks: make(map[K]*refMutex),
 	}
 }
 
-func (c *CacheLocks) Lock(id uint32) {
+func (c *CacheLocks[K]) Lock(id K) {
 	var rm *refMutex
 
 	c.mutex.Lock()
@@ -42,7 +40,7 @@ func (c *CacheLocks) Lock(id uint32) {
 	rm.mutex.Lock()
 }
 
-func (c *CacheLocks) Unlock(id uint32) {
+func (c *CacheLocks[K]) Unlock(id K) {
 	var rm *refMutex
 
 	c.mutex.Lock()
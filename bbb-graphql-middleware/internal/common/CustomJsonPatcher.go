@@ -6,20 +6,63 @@ import (
 	"fmt"
 	"strings"
 
+	"bbb-graphql-middleware/config"
+
 	evanphxjsonpatch "github.com/evanphx/json-patch"
 	"github.com/mattbaird/jsonpatch"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 )
 
-func ValidateIfShouldUseCustomJsonPatch(original []byte, modified []byte, idFieldName string) (bool, []byte) {
-	// Temporarily use CustomPatch only for UserList (testing feature)
-	if !bytes.Contains(modified, []byte("\"__typename\":\"user\"}]")) {
+var jsonPatchIdFields = config.GetConfig().Server.JsonPatchIdFields
+
+// GetJsonPatchIdField returns the id field of the list (config json_patch_id_fields),
+// looking for the operation name first and then for the __typename of the first item
+func GetJsonPatchIdField(operationName string, modified []byte) (string, bool) {
+	if idFieldName, exists := jsonPatchIdFields[strings.TrimPrefix(operationName, "Patched_")]; exists {
+		return idFieldName, true
+	}
+
+	if typename := getFirstItemTypename(modified); typename != "" {
+		idFieldName, exists := jsonPatchIdFields[typename]
+		return idFieldName, exists
+	}
+
+	return "", false
+}
+
+// getFirstItemTypename returns the __typename of the first item of the list (empty when it's not a list of objects),
+// decoding only this item
+func getFirstItemTypename(list []byte) string {
+	decoder := json.NewDecoder(bytes.NewReader(list))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('[') {
+		return ""
+	}
+	if !decoder.More() {
+		return ""
+	}
+
+	var firstItem struct {
+		Typename string `json:"__typename"`
+	}
+	if err := decoder.Decode(&firstItem); err != nil {
+		return ""
+	}
+	return firstItem.Typename
+}
+
+// ValidateIfShouldUseCustomJsonPatch creates the patch by id when the list has an id field configured,
+// and all its items have a unique id (string or number)
+func ValidateIfShouldUseCustomJsonPatch(original []byte, modified []byte, operationName string) (bool, []byte) {
+	idFieldName, hasIdField := GetJsonPatchIdField(operationName, modified)
+	if !hasIdField {
 		return false, nil
 	}
 
 	// Test Original Data
 	originalMap := GetMapFromByte(original)
 	if originalMap == nil {
+		jsonPatchFallback(operationName, "invalid_list")
 		return false, nil
 	}
 
@@ -27,18 +70,15 @@ func ValidateIfShouldUseCustomJsonPatch(original []byte, modified []byte, idFiel
 		return false, nil
 	}
 
-	firstItem := originalMap[0]
-	if _, existsIdField := firstItem[idFieldName].(string); !existsIdField {
-		return false, nil
-	}
-
-	if hasDuplicatedId(originalMap, idFieldName) {
+	if reason := validateListIds(originalMap, idFieldName); reason != "" {
+		jsonPatchFallback(operationName, reason)
 		return false, nil
 	}
 
 	// Test Modified Data
 	modifiedMap := GetMapFromByte(modified)
 	if modifiedMap == nil {
+		jsonPatchFallback(operationName, "invalid_list")
 		return false, nil
 	}
 
@@ -46,29 +86,47 @@ func ValidateIfShouldUseCustomJsonPatch(original []byte, modified []byte, idFiel
 		return false, nil
 	}
 
-	firstItem = modifiedMap[0]
-	if _, existsIdField := firstItem[idFieldName].(string); !existsIdField {
+	if reason := validateListIds(modifiedMap, idFieldName); reason != "" {
+		jsonPatchFallback(operationName, reason)
 		return false, nil
 	}
 
-	if hasDuplicatedId(modifiedMap, idFieldName) {
-		return false, nil
+	patch, recreated := createJsonPatchFromMaps(originalMap, modifiedMap, modified, idFieldName)
+	if !recreated {
+		jsonPatchFallback(operationName, "patch_mismatch")
 	}
 
-	return true, CreateJsonPatchFromMaps(originalMap, modifiedMap, modified, idFieldName)
+	return true, patch
 }
 
-func hasDuplicatedId(items []map[string]interface{}, idFieldName string) bool {
-	seen := make(map[string]bool)
+func jsonPatchFallback(operationName string, reason string) {
+	JsonPatchFallbackCounter.With(prometheus.Labels{"operationName": operationName, "reason": reason}).Inc()
+}
+
+// validateListIds returns the reason why the list can't be patched by id (empty when it can)
+func validateListIds(items []map[string]interface{}, idFieldName string) string {
+	seen := make(map[interface{}]bool, len(items))
 	for _, item := range items {
-		if idValue, existsIdField := item[idFieldName].(string); existsIdField {
-			if _, exists := seen[idValue]; exists {
-				return true
-			}
-			seen[idValue] = true
+		idValue, existsIdField := GetItemId(item, idFieldName)
+		if !existsIdField {
+			return "missing_id"
 		}
+		if _, exists := seen[idValue]; exists {
+			return "duplicated_id"
+		}
+		seen[idValue] = true
+	}
+	return ""
+}
+
+// GetItemId returns the id of the item, only strings and numbers are accepted
+func GetItemId(item map[string]interface{}, idFieldName string) (interface{}, bool) {
+	switch idValue := item[idFieldName].(type) {
+	case string, float64:
+		return idValue, true
+	default:
+		return nil, false
 	}
-	return false
 }
 
 func CreateJsonPatch(original []byte, modified []byte, idFieldName string) []byte {
@@ -79,6 +137,13 @@ func CreateJsonPatch(original []byte, modified []byte, idFieldName string) []byt
 }
 
 func CreateJsonPatchFromMaps(original []map[string]interface{}, modified []map[string]interface{}, modifiedJson []byte, idFieldName string) []byte {
+	patch, _ := createJsonPatchFromMaps(original, modified, modifiedJson, idFieldName)
+	return patch
+}
+
+// createJsonPatchFromMaps returns false when the patch by id didn't recreate the target data
+// and the generic patch was used instead
+func createJsonPatchFromMaps(original []map[string]interface{}, modified []map[string]interface{}, modifiedJson []byte, idFieldName string) ([]byte, bool) {
 	// CREATE PATCHES FOR OPERATION "REPLACE"
 	replacesPatches, originalWithReplaces := CreateReplacePatches(original, modified, idFieldName)
 
@@ -90,7 +155,7 @@ func CreateJsonPatchFromMaps(original []map[string]interface{}, modified []map[s
 
 	originalWithPatches, _ := ApplyPatch(original, mergedPatchJson)
 	if evanphxjsonpatch.Equal(originalWithPatches, modifiedJson) {
-		return mergedPatchJson
+		return mergedPatchJson, true
 	}
 
 	// CREATE PATCHES FOR OPERATION "MOVE"
@@ -99,12 +164,12 @@ func CreateJsonPatchFromMaps(original []map[string]interface{}, modified []map[s
 
 	originalWithPatches, _ = ApplyPatch(original, mergedPatchJson)
 	if evanphxjsonpatch.Equal(originalWithPatches, modifiedJson) {
-		return mergedPatchJson
+		return mergedPatchJson, true
 	} else {
 		log.Error("It was not able to recreate the target data using the patch: ", string(mergedPatchJson))
 		alternativePatch := PatchUsingMattbairdJsonpatch(original, modified)
 		alternativePatchJson, _ := json.Marshal(alternativePatch)
-		return alternativePatchJson
+		return alternativePatchJson, false
 	}
 }
 
@@ -112,7 +177,7 @@ func CreateReplacePatches(original []map[string]interface{}, modified []map[stri
 	var replacesListAsMap []map[string]interface{}
 
 	for _, originalItem := range original {
-		if id, existsIdField := originalItem[idFieldName].(string); existsIdField {
+		if id, existsIdField := GetItemId(originalItem, idFieldName); existsIdField {
 			itemInNewList := findItemWithId(modified, id, originalItem, idFieldName)
 
 			replacesListAsMap = append(replacesListAsMap, itemInNewList)
@@ -354,9 +419,9 @@ func MergePatches(patchA []byte, patchB []byte) ([]byte, error) {
 	return mergedJSON, nil
 }
 
-func findItemWithId(itemMaps []map[string]interface{}, id string, defaultValue map[string]interface{}, idFieldName string) map[string]interface{} {
+func findItemWithId(itemMaps []map[string]interface{}, id interface{}, defaultValue map[string]interface{}, idFieldName string) map[string]interface{} {
 	for _, u := range itemMaps {
-		if idField, existsIdField := u[idFieldName].(string); existsIdField {
+		if idField, existsIdField := GetItemId(u, idFieldName); existsIdField {
 			if idField == id {
 				return u
 			}
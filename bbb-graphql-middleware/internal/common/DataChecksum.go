@@ -0,0 +1,24 @@
+package common
+
+import (
+	"fmt"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// GetDataChecksum returns the 64-bit hash (xxhash) of the message, used as key of the caches
+func GetDataChecksum(data []byte) uint64 {
+	return xxhash.Sum64(data)
+}
+
+// PatchCacheKey identifies the transition between two messages, using the full checksum of both,
+// and the format of the patch
+type PatchCacheKey struct {
+	LastDataChecksum uint64
+	CurrDataChecksum uint64
+	DiffFormat       DiffFormat
+}
+
+func (k PatchCacheKey) String() string {
+	return fmt.Sprintf("%016x%016x:%s", k.LastDataChecksum, k.CurrDataChecksum, k.DiffFormat)
+}
@@ -4,7 +4,6 @@ import (
 	"bbb-graphql-middleware/config"
 	"github.com/google/uuid"
 	"sync"
-	"time"
 )
 
 var uniqueID string
@@ -17,96 +16,22 @@ func GetUniqueID() string {
 	return uniqueID
 }
 
-var PatchedMessageCache = make(map[uint32][]byte)
-var PatchedMessageCacheMutex sync.RWMutex
-
-func GetPatchedMessageCache(cacheKey uint32) ([]byte, bool) {
-	PatchedMessageCacheMutex.RLock()
-	defer PatchedMessageCacheMutex.RUnlock()
-
-	jsonDiffPatch, jsonDiffPatchExists := PatchedMessageCache[cacheKey]
-	return jsonDiffPatch, jsonDiffPatchExists
-}
-
-func StorePatchedMessageCache(cacheKey uint32, data []byte) {
-	PatchedMessageCacheMutex.Lock()
-	defer PatchedMessageCacheMutex.Unlock()
-
-	PatchedMessageCache[cacheKey] = data
-
-	//Remove the cache after 30 seconds
-	go RemovePatchedMessageCache(cacheKey, 30)
-}
-
-func RemovePatchedMessageCache(cacheKey uint32, delayInSecs time.Duration) {
-	time.Sleep(delayInSecs * time.Second)
-
-	PatchedMessageCacheMutex.Lock()
-	defer PatchedMessageCacheMutex.Unlock()
-	delete(PatchedMessageCache, cacheKey)
-}
-
-var HasuraMessageCache = make(map[uint32]HasuraMessage)
-var HasuraMessageKeyCache = make(map[uint32]string)
-var HasuraMessageCacheMutex sync.RWMutex
-
-func GetHasuraMessageCache(cacheKey uint32) (string, HasuraMessage, bool) {
-	HasuraMessageCacheMutex.RLock()
-	defer HasuraMessageCacheMutex.RUnlock()
-
-	hasuraMessageDataKey, _ := HasuraMessageKeyCache[cacheKey]
-	hasuraMessage, hasuraMessageExists := HasuraMessageCache[cacheKey]
-	return hasuraMessageDataKey, hasuraMessage, hasuraMessageExists
-}
-
-func StoreHasuraMessageCache(cacheKey uint32, dataKey string, hasuraMessage HasuraMessage) {
-	HasuraMessageCacheMutex.Lock()
-	defer HasuraMessageCacheMutex.Unlock()
-
-	HasuraMessageKeyCache[cacheKey] = dataKey
-	HasuraMessageCache[cacheKey] = hasuraMessage
-
-	//Remove the cache after 30 seconds
-	go RemoveHasuraMessageCache(cacheKey, 30)
-}
-
-func RemoveHasuraMessageCache(cacheKey uint32, delayInSecs time.Duration) {
-	time.Sleep(delayInSecs * time.Second)
-
-	HasuraMessageCacheMutex.Lock()
-	defer HasuraMessageCacheMutex.Unlock()
-	delete(HasuraMessageKeyCache, cacheKey)
-	delete(HasuraMessageCache, cacheKey)
-}
-
-var StreamCursorValueCache = make(map[uint32]interface{})
-var StreamCursorValueCacheMutex sync.RWMutex
-
-func GetStreamCursorValueCache(cacheKey uint32) (interface{}, bool) {
-	StreamCursorValueCacheMutex.RLock()
-	defer StreamCursorValueCacheMutex.RUnlock()
-
-	streamCursorValue, streamCursorValueExists := StreamCursorValueCache[cacheKey]
-	return streamCursorValue, streamCursorValueExists
+// HasuraMessageCacheEntry is a message received from Hasura already parsed, with the key of its data
+type HasuraMessageCacheEntry struct {
+	DataKey       string
+	HasuraMessage HasuraMessage
 }
 
-func StoreStreamCursorValueCache(cacheKey uint32, streamCursorValue interface{}) {
-	StreamCursorValueCacheMutex.Lock()
-	defer StreamCursorValueCacheMutex.Unlock()
-
-	StreamCursorValueCache[cacheKey] = streamCursorValue
-
-	//Remove the cache after 30 seconds
-	go RemoveStreamCursorValueCache(cacheKey, 30)
+// PatchedMessageCacheEntry is the message sent to the browsers supporting diffs, with the diff or with the full data
+type PatchedMessageCacheEntry struct {
+	Message []byte
+	IsDiff  bool
 }
 
-func RemoveStreamCursorValueCache(cacheKey uint32, delayInSecs time.Duration) {
-	time.Sleep(delayInSecs * time.Second)
-
-	StreamCursorValueCacheMutex.Lock()
-	defer StreamCursorValueCacheMutex.Unlock()
-	delete(StreamCursorValueCache, cacheKey)
-}
+var HasuraMessageCache = NewBoundedCache[uint64, HasuraMessageCacheEntry]("hasura_message")
+var PatchedMessageCache = NewBoundedCache[PatchCacheKey, PatchedMessageCacheEntry]("patched_message")
+var StreamCursorValueCache = NewBoundedCache[uint64, map[string]interface{}]("stream_cursor_value") // last row of the streaming messages
+var ParsedOperationCache = NewBoundedCache[uint64, ParsedOperation]("parsed_operation")             // info of the queries received from the browsers
 
 var MaxConnPerSessionToken = config.GetConfig().Server.MaxConnectionsPerSessionToken
 var MaxConnGlobal = config.GetConfig().Server.MaxConnections
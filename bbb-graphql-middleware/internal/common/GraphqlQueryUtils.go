@@ -0,0 +1,147 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/graphql-go/graphql/language/source"
+)
+
+// UnmarshalBrowserSubscribeMessage keeps the numbers of the variables as json.Number,
+// so the message is marshalled again without rounding them (e.g. bigint cursors above 2^53)
+func UnmarshalBrowserSubscribeMessage(message []byte) (BrowserSubscribeMessage, error) {
+	var browserMessage BrowserSubscribeMessage
+	decoder := json.NewDecoder(bytes.NewReader(message))
+	decoder.UseNumber()
+	err := decoder.Decode(&browserMessage)
+	return browserMessage, err
+}
+
+func parseQuery(query string) (*ast.Document, error) {
+	src := source.NewSource(&source.Source{
+		Body: []byte(query),
+		Name: "GraphQL query",
+	})
+	astDoc, err := parser.Parse(parser.ParseParams{
+		Source: src,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse query: %v", err)
+	}
+	return astDoc, nil
+}
+
+func CalculateQueryDepth(query string) (int, error) {
+	astDoc, err := parseQuery(query)
+	if err != nil {
+		return 0, err
+	}
+
+	return calculateDocumentDepth(astDoc), nil
+}
+
+func calculateDocumentDepth(astDoc *ast.Document) int {
+	maxDepth := 0
+	for _, def := range astDoc.Definitions {
+		if op, ok := def.(*ast.OperationDefinition); ok {
+			depth := traverseSelectionSet(op.SelectionSet, 0)
+			if depth > maxDepth {
+				maxDepth = depth
+			}
+		}
+	}
+
+	return maxDepth
+}
+
+func traverseSelectionSet(selectionSet *ast.SelectionSet, currentDepth int) int {
+	if selectionSet == nil {
+		return currentDepth
+	}
+
+	currentDepth++
+	maxDepth := currentDepth
+
+	for _, selection := range selectionSet.Selections {
+		var depth int
+		switch sel := selection.(type) {
+		case *ast.Field:
+			depth = traverseSelectionSet(sel.SelectionSet, currentDepth)
+		case *ast.InlineFragment:
+			depth = traverseSelectionSet(sel.SelectionSet, currentDepth)
+		case *ast.FragmentSpread:
+			// Without a schema, we cannot resolve fragment spreads
+			continue
+		}
+		if depth > maxDepth {
+			maxDepth = depth
+		}
+	}
+
+	return maxDepth
+}
+
+// ParsedOperation is the info of the operation executed by a GraphQL document, obtained from its AST
+type ParsedOperation struct {
+	Type          string // query, mutation or subscription
+	RootFieldName string // name (not alias) of the first root field, e.g. the action of a mutation
+	Depth         int    // depth of the document, as CalculateQueryDepth
+	Err           error  // the document couldn't be parsed, or the operation identified
+}
+
+// GetParsedOperation parses the document once for all messages with the same query and operation name
+// (they differ only by id and variables), keeping the info in ParsedOperationCache
+func GetParsedOperation(query string, operationName string) ParsedOperation {
+	cacheKey := GetDataChecksum([]byte(operationName + "\n" + query))
+	return ParsedOperationCache.GetOrLoad(cacheKey, len(operationName)+len(query), func() (ParsedOperation, int) {
+		return parseOperation(query, operationName), len(query)
+	})
+}
+
+func parseOperation(query string, operationName string) ParsedOperation {
+	astDoc, err := parseQuery(query)
+	if err != nil {
+		return ParsedOperation{Err: err}
+	}
+
+	operation, err := getOperation(astDoc, operationName)
+	if err != nil {
+		return ParsedOperation{Err: err}
+	}
+
+	parsedOperation := ParsedOperation{
+		Type:  operation.Operation,
+		Depth: calculateDocumentDepth(astDoc),
+	}
+	if operation.SelectionSet != nil {
+		for _, selection := range operation.SelectionSet.Selections {
+			if field, isField := selection.(*ast.Field); isField {
+				parsedOperation.RootFieldName = field.Name.Value
+				break
+			}
+		}
+	}
+	return parsedOperation
+}
+
+// getOperation returns the operation executed by the document: the one named operationName or,
+// when there is no operation with this name, the only operation of the document
+func getOperation(astDoc *ast.Document, operationName string) (*ast.OperationDefinition, error) {
+	var operations []*ast.OperationDefinition
+	for _, def := range astDoc.Definitions {
+		if op, ok := def.(*ast.OperationDefinition); ok {
+			if operationName != "" && op.Name != nil && op.Name.Value == operationName {
+				return op, nil
+			}
+			operations = append(operations, op)
+		}
+	}
+
+	if len(operations) != 1 {
+		return nil, fmt.Errorf("unable to identify the operation %s among %d operations", operationName, len(operations))
+	}
+	return operations[0], nil
+}
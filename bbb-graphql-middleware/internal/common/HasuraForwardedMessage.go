@@ -0,0 +1,23 @@
+package common
+
+import (
+	"bytes"
+)
+
+// forwardedMutationMarker prefixes the mutations sent to the hasura channel by GraphqlActionsClient
+// (config graphql-actions.mutation_routes), whose limits were already applied there.
+// Messages received from the browser can't start with it, as they are valid json.
+var forwardedMutationMarker = []byte{0}
+
+// MarkAsForwardedMutation marks the mutation sent to Hasura by GraphqlActionsClient
+func MarkAsForwardedMutation(message []byte) []byte {
+	return append(append(make([]byte, 0, len(forwardedMutationMarker)+len(message)), forwardedMutationMarker...), message...)
+}
+
+// UnmarkForwardedMutation returns the message without the mark, and whether it was forwarded by GraphqlActionsClient
+func UnmarkForwardedMutation(message []byte) ([]byte, bool) {
+	if bytes.HasPrefix(message, forwardedMutationMarker) {
+		return message[len(forwardedMutationMarker):], true
+	}
+	return message, false
+}
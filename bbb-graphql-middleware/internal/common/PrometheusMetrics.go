@@ -26,7 +26,7 @@ var (
 			Name: "ws_connection_rejected",
 			Help: "Total number of Websocket connections rejected",
 		},
-		[]string{"reason"},
+		[]string{"reason", "origin"},
 	)
 	GqlSubscribeCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
@@ -95,6 +95,203 @@ var (
 		},
 		[]string{"application"},
 	)
+	DistributedLimitsFallbackCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "distributed_limits_fallback_total",
+			Help: "Total number of times the local limits were used because Redis was unreachable",
+		},
+		[]string{"operation"},
+	)
+	OperationPolicyRejectedCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gql_operation_policy_rejected_total",
+			Help: "Total number of operations rejected by a policy (operation_policies or connection limits)",
+		},
+		[]string{"policy", "reason"},
+	)
+	HooksCacheCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "hook_cache_total",
+			Help: "Total number of auth/session-vars hook lookups by result (hit, miss, shared)",
+		},
+		[]string{"hook", "result"},
+	)
+	GqlActionsRetriesCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gql_actions_retries_total",
+			Help: "Total number of retries of requests to graphql-actions",
+		},
+		[]string{"action", "reason"},
+	)
+	GqlActionsCoalescedCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gql_actions_coalesced_total",
+			Help: "Total number of mutations merged into another request to graphql-actions",
+		},
+		[]string{"action", "mode"},
+	)
+	GqlActionsLaneRejectedCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gql_actions_lane_rejected_total",
+			Help: "Total number of mutations rejected because the queue of their priority lane was full",
+		},
+		[]string{"lane"},
+	)
+	GqlActionsInterceptedCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gql_actions_intercepted_total",
+			Help: "Total number of mutations rejected or answered by an interceptor",
+		},
+		[]string{"interceptor", "result"},
+	)
+	AuditRecordsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "audit_records_total",
+			Help: "Total number of audit records (written, failed or dropped)",
+		},
+		[]string{"result"},
+	)
+	GqlActionsDuplicatesCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gql_actions_duplicates_total",
+			Help: "Total number of duplicated mutations answered with the response of the first one, without being sent",
+		},
+		[]string{"action"},
+	)
+	JsonPatchFallbackCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gql_json_patch_fallback_total",
+			Help: "Total number of lists with id field configured that could not be diffed by id, or merge-patches of lists (generic json-patch or full data used)",
+		},
+		[]string{"operationName", "reason"},
+	)
+	GqlDiffMessagesCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gql_diff_messages_total",
+			Help: "Total number of subscription changes sent to the browsers (per connection) by diff format, as diff or as full data",
+		},
+		[]string{"operationName", "format", "result"},
+	)
+	GqlResyncCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gql_resync_total",
+			Help: "Total number of resyncs requested by the browsers (result sent, no_data or not_found)",
+		},
+		[]string{"operationName", "result"},
+	)
+	GqlPatchBytesSavedCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gql_patch_bytes_saved_total",
+			Help: "Total of bytes not sent to the browsers because the changes were sent as diff instead of the full data",
+		},
+		[]string{"operationName"},
+	)
+	GqlPatchGenerationDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "gql_patch_generation_duration_milliseconds",
+			Help: "Duration of the creation of the diffs (once per change, shared by all connections)",
+			Buckets: []float64{
+				0.1,
+				0.5,
+				1,
+				5,
+				10,
+				50,
+				100,
+				500,
+			},
+		},
+		[]string{"operationName", "format"},
+	)
+	PatchVerificationCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gql_patch_verification_total",
+			Help: "Total number of patches verified by applying them to the previous data (result match, mismatch or error)",
+		},
+		[]string{"operationName", "format", "result"},
+	)
+	WsBytesCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ws_bytes_total",
+			Help: "Total of bytes of the websocket messages, raw (before compression) or wire (sent/received through the network)",
+		},
+		[]string{"connection", "direction", "type"},
+	)
+	WsCompressionCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ws_compression_connections_total",
+			Help: "Total number of websocket connections with compression enabled in config, by result of the negotiation",
+		},
+		[]string{"connection", "result"},
+	)
+	GqlSentBytesCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gql_sent_bytes_total",
+			Help: "Total of bytes sent to the browser by operation, before compression (prometheus_advanced_metrics_enabled)",
+		},
+		[]string{"operationName"},
+	)
+	CacheHitsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cache_hits_total",
+			Help: "Total number of cache lookups that found the entry",
+		},
+		[]string{"cache"},
+	)
+	CacheMissesCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cache_misses_total",
+			Help: "Total number of cache lookups that didn't find the entry",
+		},
+		[]string{"cache"},
+	)
+	CacheEvictionsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cache_evictions_total",
+			Help: "Total number of cache entries removed (expired or size_limit)",
+		},
+		[]string{"cache", "reason"},
+	)
+	CacheSizeBytesGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cache_size_bytes",
+			Help: "Estimated size of the cache entries",
+		},
+		[]string{"cache"},
+	)
+	CacheEntriesGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cache_entries",
+			Help: "Number of cache entries",
+		},
+		[]string{"cache"},
+	)
+	HttpClientRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "http_client_request_duration_milliseconds",
+			Help: "Duration of the requests sent to graphql-actions and hooks",
+			Buckets: []float64{
+				5,
+				20,
+				50,
+				100,
+				250,
+				500,
+				1000,
+				2500,
+				5000,
+				10000,
+			},
+		},
+		[]string{"upstream"},
+	)
+	HttpClientErrorsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_client_errors_total",
+			Help: "Total number of failed requests sent to graphql-actions and hooks",
+		},
+		[]string{"upstream", "reason"},
+	)
 )
 
 func init() {
@@ -110,4 +307,29 @@ func init() {
 		prometheus.MustRegister(GqlReceivedDataPayloadLength)
 	}
 	prometheus.MustRegister(ApplicationsLatency)
+	prometheus.MustRegister(DistributedLimitsFallbackCounter)
+	prometheus.MustRegister(OperationPolicyRejectedCounter)
+	prometheus.MustRegister(HooksCacheCounter)
+	prometheus.MustRegister(GqlActionsRetriesCounter)
+	prometheus.MustRegister(GqlActionsCoalescedCounter)
+	prometheus.MustRegister(GqlActionsLaneRejectedCounter)
+	prometheus.MustRegister(GqlActionsInterceptedCounter)
+	prometheus.MustRegister(AuditRecordsCounter)
+	prometheus.MustRegister(GqlActionsDuplicatesCounter)
+	prometheus.MustRegister(JsonPatchFallbackCounter)
+	prometheus.MustRegister(GqlDiffMessagesCounter)
+	prometheus.MustRegister(GqlResyncCounter)
+	prometheus.MustRegister(GqlPatchBytesSavedCounter)
+	prometheus.MustRegister(GqlPatchGenerationDuration)
+	prometheus.MustRegister(PatchVerificationCounter)
+	prometheus.MustRegister(WsBytesCounter)
+	prometheus.MustRegister(WsCompressionCounter)
+	prometheus.MustRegister(GqlSentBytesCounter)
+	prometheus.MustRegister(CacheHitsCounter)
+	prometheus.MustRegister(CacheMissesCounter)
+	prometheus.MustRegister(CacheEvictionsCounter)
+	prometheus.MustRegister(CacheSizeBytesGauge)
+	prometheus.MustRegister(CacheEntriesGauge)
+	prometheus.MustRegister(HttpClientRequestDuration)
+	prometheus.MustRegister(HttpClientErrorsCounter)
 }
@@ -0,0 +1,18 @@
+package common
+
+import (
+	"fmt"
+
+	"bbb-graphql-middleware/config"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// NewRedisClient creates a client to the Redis server of config redis
+func NewRedisClient() *redis.Client {
+	return redis.NewClient(&redis.Options{
+		Addr:     fmt.Sprintf("%s:%d", config.GetConfig().Redis.Host, config.GetConfig().Redis.Port),
+		Password: config.GetConfig().Redis.Password,
+		DB:       0,
+	})
+}
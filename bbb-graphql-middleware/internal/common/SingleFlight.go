@@ -0,0 +1,49 @@
+package common
+
+import (
+	"sync"
+)
+
+// SingleFlight deduplicates concurrent calls with the same key:
+// while a call is in flight, other callers of the same key wait and receive its result
+type SingleFlight[T any] struct {
+	calls map[string]*singleFlightCall[T]
+	mutex sync.Mutex // Protects the 'calls' map
+}
+
+type singleFlightCall[T any] struct {
+	wg    sync.WaitGroup
+	value T
+	err   error
+}
+
+func NewSingleFlight[T any]() *SingleFlight[T] {
+	return &SingleFlight[T]{
+		calls: make(map[string]*singleFlightCall[T]),
+	}
+}
+
+// Do executes fn once for all concurrent callers of key, shared indicates the result came from another caller
+func (s *SingleFlight[T]) Do(key string, fn func() (T, error)) (value T, err error, shared bool) {
+	s.mutex.Lock()
+	if call, exists := s.calls[key]; exists {
+		s.mutex.Unlock()
+		call.wg.Wait()
+		return call.value, call.err, true
+	}
+
+	call := &singleFlightCall[T]{}
+	call.wg.Add(1)
+	s.calls[key] = call
+	s.mutex.Unlock()
+
+	defer func() {
+		s.mutex.Lock()
+		delete(s.calls, key)
+		s.mutex.Unlock()
+		call.wg.Done()
+	}()
+
+	call.value, call.err = fn()
+	return call.value, call.err, false
+}
@@ -1,152 +1,277 @@
 package common
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
-	log "github.com/sirupsen/logrus"
-	"hash/crc32"
-	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/kinds"
+	"github.com/graphql-go/graphql/language/printer"
+	log "github.com/sirupsen/logrus"
 )
 
-func GetStreamCursorPropsFromBrowserMessage(browserMessage BrowserSubscribeMessage) (string, string, interface{}) {
-	streamCursorField := ""
-	streamCursorVariableName := ""
-	var streamCursorInitialValue interface{}
-
-	cursorInitialValueRePattern := regexp.MustCompile(`cursor:\s*\{\s*initial_value\s*:\s*\{\s*([^:]+):\s*([^}]+)\s*}\s*}`)
-	matches := cursorInitialValueRePattern.FindStringSubmatch(browserMessage.Payload.Query)
-	if matches != nil {
-		streamCursorField = matches[1]
-		if strings.HasPrefix(matches[2], "$") {
-			streamCursorVariableName, _ = strings.CutPrefix(matches[2], "$")
-			if targetVariableValue, okTargetVariableValue := browserMessage.Payload.Variables[streamCursorVariableName]; okTargetVariableValue {
-				streamCursorInitialValue = targetVariableValue
+// getStreamCursorInitialValues returns the field `<table>_stream` of the subscription and the initial_value
+// of each object of its argument cursor (a single object or a list of them, along with ordering)
+func getStreamCursorInitialValues(astDoc *ast.Document) (*ast.Field, []*ast.ObjectField) {
+	for _, definition := range astDoc.Definitions {
+		operation, isOperation := definition.(*ast.OperationDefinition)
+		if !isOperation || operation.Operation != ast.OperationTypeSubscription || operation.SelectionSet == nil {
+			continue
+		}
+
+		for _, selection := range operation.SelectionSet.Selections {
+			field, isField := selection.(*ast.Field)
+			if !isField || !strings.HasSuffix(field.Name.Value, "_stream") {
+				continue
+			}
+
+			for _, argument := range field.Arguments {
+				if argument.Name.Value != "cursor" {
+					continue
+				}
+
+				cursorObjects := []ast.Value{argument.Value}
+				if cursorList, isList := argument.Value.(*ast.ListValue); isList {
+					cursorObjects = cursorList.Values
+				}
+
+				var initialValues []*ast.ObjectField
+				for _, cursorObject := range cursorObjects {
+					if cursorObjectValue, isObject := cursorObject.(*ast.ObjectValue); isObject {
+						for _, cursorField := range cursorObjectValue.Fields {
+							if cursorField.Name.Value == "initial_value" {
+								initialValues = append(initialValues, cursorField)
+							}
+						}
+					}
+				}
+				return field, initialValues
 			}
-		} else {
-			streamCursorInitialValue = matches[2]
 		}
 	}
 
-	return streamCursorField, streamCursorVariableName, streamCursorInitialValue
+	return nil, nil
 }
 
-func GetLastStreamCursorValueFromReceivedMessage(message []byte, streamCursorField string) interface{} {
-	dataChecksum := crc32.ChecksumIEEE(message)
-	GlobalCacheLocks.Lock(dataChecksum)
-
-	if streamCursorValueCache, streamCursorValueCacheExists := GetStreamCursorValueCache(dataChecksum); streamCursorValueCacheExists {
-		//Unlock immediately once the cache was already created by other routine
-		GlobalCacheLocks.Unlock(dataChecksum)
-		return streamCursorValueCache
-	} else {
-		//It will create the cache and then Unlock (others will wait to benefit from this cache)
-		defer GlobalCacheLocks.Unlock(dataChecksum)
+// GetStreamCursorPropsFromBrowserMessage returns the fields of the cursor of a streaming subscription,
+// with their initial values (set inline in the query or through variables)
+func GetStreamCursorPropsFromBrowserMessage(browserMessage BrowserSubscribeMessage) ([]StreamCursorField, map[string]interface{}) {
+	astDoc, err := parseQuery(browserMessage.Payload.Query)
+	if err != nil {
+		log.Errorf("failed to parse streaming subscription %s: %v", browserMessage.Payload.OperationName, err)
+		return nil, nil
 	}
 
-	var lastStreamCursorValue interface{}
+	_, initialValues := getStreamCursorInitialValues(astDoc)
 
-	var messageAsMap map[string]interface{}
-	err := json.Unmarshal(message, &messageAsMap)
-	if err != nil {
-		log.Errorf("failed to unmarshal message: %v", err)
-		//return
-	}
-
-	if payload, okPayload := messageAsMap["payload"].(map[string]interface{}); okPayload {
-		if data, okData := payload["data"].(map[string]interface{}); okData {
-			//Data will have only one prop, `range` because its name is unknown
-			for _, dataItem := range data {
-				currentDataProp, okCurrentDataProp := dataItem.([]interface{})
-				if okCurrentDataProp && len(currentDataProp) > 0 {
-					// Get the last item directly (once it will contain the last cursor value)
-					lastItemOfMessage := currentDataProp[len(currentDataProp)-1]
-					if lastItemOfMessageAsMap, currDataOk := lastItemOfMessage.(map[string]interface{}); currDataOk {
-						if lastItemValue, okLastItemValue := lastItemOfMessageAsMap[streamCursorField]; okLastItemValue {
-							lastStreamCursorValue = lastItemValue
-						}
+	var streamCursorFields []StreamCursorField
+	streamCursorValues := make(map[string]interface{})
+	for _, initialValue := range initialValues {
+		switch initialValueNode := initialValue.Value.(type) {
+		case *ast.ObjectValue:
+			for _, objectField := range initialValueNode.Fields {
+				streamCursorField := StreamCursorField{
+					Name:      objectField.Name.Value,
+					ValueKind: objectField.Value.GetKind(),
+				}
+				if variable, isVariable := objectField.Value.(*ast.Variable); isVariable {
+					streamCursorField.VariableName = variable.Name.Value
+					if variableValue, exists := browserMessage.Payload.Variables[streamCursorField.VariableName]; exists {
+						streamCursorValues[streamCursorField.Name] = variableValue
 					}
+				} else {
+					streamCursorValues[streamCursorField.Name] = getLiteralValue(objectField.Value)
 				}
+				streamCursorFields = append(streamCursorFields, streamCursorField)
+			}
+		case *ast.Variable:
+			// The whole initial_value is set through a variable, its keys are the cursor fields
+			variableName := initialValueNode.Name.Value
+			variableValue, _ := browserMessage.Payload.Variables[variableName].(map[string]interface{})
+			keys := make([]string, 0, len(variableValue))
+			for key := range variableValue {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				streamCursorFields = append(streamCursorFields, StreamCursorField{
+					Name:         key,
+					VariableName: variableName,
+					VariableKey:  key,
+					ValueKind:    kinds.Variable,
+				})
+				streamCursorValues[key] = variableValue[key]
 			}
 		}
 	}
 
-	StoreStreamCursorValueCache(dataChecksum, lastStreamCursorValue)
-	return lastStreamCursorValue
+	if len(streamCursorFields) == 0 {
+		return nil, nil
+	}
+	return streamCursorFields, streamCursorValues
+}
+
+func getLiteralValue(value ast.Value) interface{} {
+	switch v := value.(type) {
+	case *ast.IntValue:
+		return json.Number(v.Value)
+	case *ast.FloatValue:
+		return json.Number(v.Value)
+	case *ast.BooleanValue:
+		return v.Value
+	default:
+		// strings (timestamps, uuids...) and enums
+		return value.GetValue()
+	}
+}
+
+// GetLastStreamCursorValuesFromReceivedMessage returns the value of the cursor fields in the last row of the message,
+// that is where the stream continues (for both orderings, ASC and DESC). It's nil when the row lacks any of them.
+// Hasura resumes after these values (exclusive), so the cursor must be unique: with a non-unique cursor (e.g. createdAt)
+// the rows sharing the last value that were not received yet are skipped after a reconnection, unless a unique field
+// is part of a composite cursor.
+func GetLastStreamCursorValuesFromReceivedMessage(message []byte, streamCursorFields []StreamCursorField) map[string]interface{} {
+	if len(streamCursorFields) == 0 {
+		return nil
+	}
+
+	lastRow := StreamCursorValueCache.GetOrLoad(GetDataChecksum(message), len(message), func() (map[string]interface{}, int) {
+		return getLastStreamRow(message)
+	})
+	if lastRow == nil {
+		return nil
+	}
+
+	// All the values are taken from the same row, so a composite cursor resumes exactly after it
+	lastStreamCursorValues := make(map[string]interface{}, len(streamCursorFields))
+	for _, streamCursorField := range streamCursorFields {
+		lastValue, exists := lastRow[streamCursorField.Name]
+		if !exists {
+			return nil
+		}
+		lastStreamCursorValues[streamCursorField.Name] = lastValue
+	}
+
+	return lastStreamCursorValues
+}
+
+// getLastStreamRow returns the last row of the message (numbers are kept as json.Number, so they are not rounded)
+// and its size in bytes
+func getLastStreamRow(message []byte) (map[string]interface{}, int) {
+	var hasuraMessage struct {
+		Payload struct {
+			Data map[string]json.RawMessage `json:"data"`
+		} `json:"payload"`
+	}
+	if err := json.Unmarshal(message, &hasuraMessage); err != nil {
+		log.Errorf("failed to unmarshal message: %v", err)
+		return nil, 0
+	}
+
+	//Data will have only one prop, `range` because its name is unknown
+	for _, dataItem := range hasuraMessage.Payload.Data {
+		var rows []json.RawMessage
+		if err := json.Unmarshal(dataItem, &rows); err != nil || len(rows) == 0 {
+			continue
+		}
+
+		lastRowJson := rows[len(rows)-1]
+		decoder := json.NewDecoder(bytes.NewReader(lastRowJson))
+		decoder.UseNumber()
+		var lastRow map[string]interface{}
+		if err := decoder.Decode(&lastRow); err != nil {
+			continue
+		}
+		return lastRow, len(lastRowJson)
+	}
+
+	return nil, 0
 }
 
-func PatchQueryIncludingCursorField(originalQuery string, cursorField string) string {
-	if cursorField == "" {
+// PatchQueryIncludingCursorFields adds the cursor fields missing in the selection of the stream,
+// to be able to store the last cursor value received
+func PatchQueryIncludingCursorFields(originalQuery string, streamCursorFields []StreamCursorField) string {
+	if len(streamCursorFields) == 0 {
+		return originalQuery
+	}
+
+	astDoc, err := parseQuery(originalQuery)
+	if err != nil {
 		return originalQuery
 	}
 
-	lastIndexOfTypename := LastButOneIndex(originalQuery, "}")
-	if lastIndexOfTypename == -1 {
+	streamField, _ := getStreamCursorInitialValues(astDoc)
+	if streamField == nil || streamField.SelectionSet == nil {
 		return originalQuery
 	}
 
-	// It will include the cursorField at the end of the list of fields
-	// It's not a problem if the field be duplicated in the list, Hasura just ignore the second occurrence
-	return originalQuery[:lastIndexOfTypename] + "  " + cursorField + "\n  " + originalQuery[lastIndexOfTypename:]
+	selectedFields := make(map[string]bool)
+	for _, selection := range streamField.SelectionSet.Selections {
+		// Aliased fields are returned with another name, so the field is included without alias
+		if field, isField := selection.(*ast.Field); isField && field.Alias == nil {
+			selectedFields[field.Name.Value] = true
+		}
+	}
+
+	patched := false
+	for _, streamCursorField := range streamCursorFields {
+		if !selectedFields[streamCursorField.Name] {
+			streamField.SelectionSet.Selections = append(streamField.SelectionSet.Selections, ast.NewField(&ast.Field{
+				Name: ast.NewName(&ast.Name{Value: streamCursorField.Name}),
+			}))
+			selectedFields[streamCursorField.Name] = true
+			patched = true
+		}
+	}
+
+	if !patched {
+		return originalQuery
+	}
+	return printQuery(astDoc, originalQuery)
 }
 
+// PatchQuerySettingLastCursorValue sets the last cursor values received as the initial values of the stream,
+// so the subscription resumes after the last row received (used when reconnecting to Hasura)
 func PatchQuerySettingLastCursorValue(subscription GraphQlSubscription) []byte {
-	var browserMessage BrowserSubscribeMessage
-	err := json.Unmarshal(subscription.Message, &browserMessage)
+	browserMessage, err := UnmarshalBrowserSubscribeMessage(subscription.Message)
 	if err != nil {
 		log.Errorf("failed to unmarshal message: %v", err)
 		return subscription.Message
 	}
 
-	if subscription.StreamCursorVariableName != "" {
-		/**** This stream has its cursor value set through variables ****/
-		if browserMessage.Payload.Variables[subscription.StreamCursorVariableName] == subscription.StreamCursorCurrValue {
-			return subscription.Message
+	inlineValues := make(map[string]interface{})
+	for _, streamCursorField := range subscription.StreamCursorFields {
+		currValue, exists := subscription.StreamCursorCurrValues[streamCursorField.Name]
+		if !exists {
+			continue
 		}
-		browserMessage.Payload.Variables[subscription.StreamCursorVariableName] = subscription.StreamCursorCurrValue
-	} else {
-		/**** This stream has its cursor value set through inline value (not variables) ****/
-		cursorInitialValueRePattern := regexp.MustCompile(`cursor:\s*\{\s*initial_value\s*:\s*\{\s*([^:]+:\s*[^}]+)\s*}\s*}`)
-		newValue := ""
 
-		replaceInitialValueFunc := func(match string) string {
-			switch v := subscription.StreamCursorCurrValue.(type) {
-			case string:
-				newValue = v
-
-				//Append quotes if it is missing, it will be necessary when appending to the query
-				if !strings.HasPrefix(v, "\"") {
-					newValue = "\"" + newValue
-				}
-				if !strings.HasSuffix(v, "\"") {
-					newValue = newValue + "\""
-				}
-			case int:
-				newValue = strconv.Itoa(v)
-			case float32:
-				myFloat64 := float64(v)
-				newValue = strconv.FormatFloat(myFloat64, 'f', -1, 32)
-			case float64:
-				newValue = strconv.FormatFloat(v, 'f', -1, 64)
-			default:
-				newValue = ""
+		switch {
+		case streamCursorField.VariableName == "":
+			/**** This field has its cursor value set through inline value (not variables) ****/
+			inlineValues[streamCursorField.Name] = currValue
+		case streamCursorField.VariableKey == "":
+			/**** This field has its cursor value set through variables ****/
+			if browserMessage.Payload.Variables == nil {
+				browserMessage.Payload.Variables = make(map[string]interface{})
 			}
-
-			if newValue != "" {
-				replacement := subscription.StreamCursorField + ": " + newValue
-				return fmt.Sprintf("cursor: {initial_value: {%s}}", replacement)
-			} else {
-				return match
+			browserMessage.Payload.Variables[streamCursorField.VariableName] = currValue
+		default:
+			/**** The whole initial_value is set through a variable ****/
+			variableValue, _ := browserMessage.Payload.Variables[streamCursorField.VariableName].(map[string]interface{})
+			if variableValue == nil {
+				continue
 			}
+			variableValue[streamCursorField.VariableKey] = currValue
 		}
+	}
 
-		newQuery := cursorInitialValueRePattern.ReplaceAllStringFunc(browserMessage.Payload.Query, replaceInitialValueFunc)
-		if browserMessage.Payload.Query == newQuery {
-			return subscription.Message
-		}
-
-		browserMessage.Payload.Query = newQuery
+	if len(inlineValues) > 0 {
+		browserMessage.Payload.Query = patchQueryInlineCursorValues(browserMessage.Payload.Query, subscription.StreamCursorFields, inlineValues)
 	}
 
 	newMessageJson, _ := json.Marshal(browserMessage)
@@ -154,11 +279,142 @@ func PatchQuerySettingLastCursorValue(subscription GraphQlSubscription) []byte {
 	return newMessageJson
 }
 
-func LastButOneIndex(s, substr string) int {
-	last := strings.LastIndex(s, substr)
-	if last == -1 {
-		return -1
+func patchQueryInlineCursorValues(query string, streamCursorFields []StreamCursorField, values map[string]interface{}) string {
+	astDoc, err := parseQuery(query)
+	if err != nil {
+		log.Errorf("failed to set the cursor of the streaming subscription: %v", err)
+		return query
+	}
+
+	valueKinds := make(map[string]string, len(streamCursorFields))
+	for _, streamCursorField := range streamCursorFields {
+		valueKinds[streamCursorField.Name] = streamCursorField.ValueKind
+	}
+
+	_, initialValues := getStreamCursorInitialValues(astDoc)
+	for _, initialValue := range initialValues {
+		initialValueObject, isObject := initialValue.Value.(*ast.ObjectValue)
+		if !isObject {
+			continue
+		}
+		for _, objectField := range initialValueObject.Fields {
+			if value, exists := values[objectField.Name.Value]; exists {
+				objectField.Value = newCursorValueNode(valueKinds[objectField.Name.Value], value)
+			}
+		}
+	}
+
+	return printQuery(astDoc, query)
+}
+
+// newCursorValueNode creates the literal of the value with the kind of the initial value of the query,
+// as Hasura returns enums as strings and, optionally, numbers (bigint, numeric) as strings as well
+func newCursorValueNode(valueKind string, value interface{}) ast.Value {
+	var valueAsString string
+	switch v := value.(type) {
+	case bool:
+		return ast.NewBooleanValue(&ast.BooleanValue{Value: v})
+	case float64:
+		valueAsString = strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		valueAsString = fmt.Sprint(v)
+	}
+
+	switch valueKind {
+	case kinds.EnumValue:
+		return ast.NewEnumValue(&ast.EnumValue{Value: valueAsString})
+	case kinds.IntValue:
+		return ast.NewIntValue(&ast.IntValue{Value: valueAsString})
+	case kinds.FloatValue:
+		return ast.NewFloatValue(&ast.FloatValue{Value: valueAsString})
+	case kinds.StringValue:
+		return ast.NewStringValue(&ast.StringValue{Value: valueAsString})
+	}
+
+	switch value.(type) {
+	case json.Number, float64:
+		if strings.ContainsAny(valueAsString, ".eE") {
+			return ast.NewFloatValue(&ast.FloatValue{Value: valueAsString})
+		}
+		return ast.NewIntValue(&ast.IntValue{Value: valueAsString})
+	default:
+		return ast.NewStringValue(&ast.StringValue{Value: valueAsString})
+	}
+}
+
+// printQuery prints the query with the strings escaped as GraphQL strings, as the printer quotes them
+// using strconv.Quote, whose escapes \x, \a, \v and \U are not valid in GraphQL
+func printQuery(astDoc *ast.Document, originalQuery string) string {
+	printedQuery, isString := printer.Print(astDoc).(string)
+	if !isString {
+		log.Errorf("failed to print the query: %s", originalQuery)
+		return originalQuery
+	}
+	return requoteStringValues(printedQuery)
+}
+
+// requoteStringValues replaces the strings quoted by strconv.Quote with GraphQL strings
+// (the printed query contains no comments or block strings, so any `"` starts a string)
+func requoteStringValues(printedQuery string) string {
+	var requotedQuery strings.Builder
+	for {
+		start := strings.IndexByte(printedQuery, '"')
+		if start < 0 {
+			requotedQuery.WriteString(printedQuery)
+			return requotedQuery.String()
+		}
+
+		end := start + 1
+		for end < len(printedQuery) && printedQuery[end] != '"' {
+			if printedQuery[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(printedQuery) {
+			requotedQuery.WriteString(printedQuery)
+			return requotedQuery.String()
+		}
+
+		requotedQuery.WriteString(printedQuery[:start])
+		if value, err := strconv.Unquote(printedQuery[start : end+1]); err == nil {
+			requotedQuery.WriteString(quoteGraphqlString(value))
+		} else {
+			requotedQuery.WriteString(printedQuery[start : end+1])
+		}
+		printedQuery = printedQuery[end+1:]
 	}
+}
 
-	return strings.LastIndex(s[:last], substr)
+// quoteGraphqlString quotes the value using only the escapes allowed in GraphQL strings
+func quoteGraphqlString(value string) string {
+	var quoted strings.Builder
+	quoted.WriteByte('"')
+	for _, r := range value {
+		switch r {
+		case '"':
+			quoted.WriteString(`\"`)
+		case '\\':
+			quoted.WriteString(`\\`)
+		case '\b':
+			quoted.WriteString(`\b`)
+		case '\f':
+			quoted.WriteString(`\f`)
+		case '\n':
+			quoted.WriteString(`\n`)
+		case '\r':
+			quoted.WriteString(`\r`)
+		case '\t':
+			quoted.WriteString(`\t`)
+		default:
+			if r < 0x20 {
+				// Other control characters are not allowed in GraphQL strings
+				fmt.Fprintf(&quoted, `\u%04x`, r)
+			} else {
+				quoted.WriteRune(r)
+			}
+		}
+	}
+	quoted.WriteByte('"')
+	return quoted.String()
 }
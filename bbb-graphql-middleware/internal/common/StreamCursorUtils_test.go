@@ -0,0 +1,151 @@
+package common
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// resumeStream receives the row in the stream and returns the message sent to Hasura when reconnecting
+func resumeStream(t *testing.T, browserMessageJson string, lastRowJson string) BrowserSubscribeMessage {
+	browserMessage, err := UnmarshalBrowserSubscribeMessage([]byte(browserMessageJson))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	streamCursorFields, streamCursorValues := GetStreamCursorPropsFromBrowserMessage(browserMessage)
+	if len(streamCursorFields) == 0 {
+		t.Fatalf("no cursor found in %s", browserMessage.Payload.Query)
+	}
+	browserMessage.Payload.Query = PatchQueryIncludingCursorFields(browserMessage.Payload.Query, streamCursorFields)
+	if _, err := parseQuery(browserMessage.Payload.Query); err != nil {
+		t.Fatalf("invalid query including the cursor fields: %v\n%s", err, browserMessage.Payload.Query)
+	}
+	message, _ := json.Marshal(browserMessage)
+
+	receivedMessage := `{"type":"next","id":"1","payload":{"data":{"chat_message_stream":[{"messageId":"first"},` + lastRowJson + `]}}}`
+	lastValues := GetLastStreamCursorValuesFromReceivedMessage([]byte(receivedMessage), streamCursorFields)
+	if lastValues == nil {
+		t.Fatalf("cursor values not found in %s", lastRowJson)
+	}
+	if len(lastValues) != len(streamCursorValues) {
+		t.Fatalf("last values %v don't match the cursor fields %v", lastValues, streamCursorValues)
+	}
+
+	resumedMessage, err := UnmarshalBrowserSubscribeMessage(PatchQuerySettingLastCursorValue(GraphQlSubscription{
+		Message:                message,
+		StreamCursorFields:     streamCursorFields,
+		StreamCursorCurrValues: lastValues,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resumedMessage
+}
+
+// getInlineCursorValues returns the inline values of the cursor of the query
+func getInlineCursorValues(t *testing.T, query string) map[string]interface{} {
+	if _, err := parseQuery(query); err != nil {
+		t.Fatalf("invalid query: %v\n%s", err, query)
+	}
+	var browserMessage BrowserSubscribeMessage
+	browserMessage.Payload.Query = query
+	_, values := GetStreamCursorPropsFromBrowserMessage(browserMessage)
+	return values
+}
+
+func TestResumeStreamCursor(t *testing.T) {
+	tests := []struct {
+		name                 string
+		browserMessage       string
+		lastRow              string
+		expectedInlineValues map[string]interface{}
+		expectedVariables    string
+	}{
+		{
+			name: "inline value",
+			browserMessage: `{"type":"subscribe","id":"1","payload":{"query":"subscription S { chat_message_stream(batch_size: 10, ` +
+				`cursor: {initial_value: {createdAt: \"2020-01-01\"}, ordering: ASC}) { messageId } }"}}`,
+			lastRow:              `{"messageId":"a","createdAt":"2020-01-02"}`,
+			expectedInlineValues: map[string]interface{}{"createdAt": "2020-01-02"},
+		},
+		{
+			name: "inline value above 2^53",
+			browserMessage: `{"type":"subscribe","id":"1","payload":{"query":"subscription S { chat_message_stream(batch_size: 10, ` +
+				`cursor: {initial_value: {id: 9007199254740993}}) { messageId id } }"}}`,
+			lastRow:              `{"messageId":"a","id":9007199254740995}`,
+			expectedInlineValues: map[string]interface{}{"id": json.Number("9007199254740995")},
+		},
+		{
+			name: "composite inline value",
+			browserMessage: `{"type":"subscribe","id":"1","payload":{"query":"subscription S { chat_message_stream(batch_size: 10, ` +
+				`cursor: {initial_value: {createdAt: \"2020-01-01\", id: 0}}) { messageId } }"}}`,
+			lastRow:              `{"messageId":"a","createdAt":"2020-01-02","id":5}`,
+			expectedInlineValues: map[string]interface{}{"createdAt": "2020-01-02", "id": json.Number("5")},
+		},
+		{
+			name: "per-field variable above 2^53",
+			browserMessage: `{"type":"subscribe","id":"1","payload":{"query":"subscription S($id: bigint, $other: bigint) { ` +
+				`chat_message_stream(batch_size: 10, cursor: {initial_value: {id: $id}}) { messageId id } }",` +
+				`"variables":{"id":9007199254740993,"other":9007199254740997}}}`,
+			lastRow:           `{"messageId":"a","id":9007199254740995}`,
+			expectedVariables: `{"id":9007199254740995,"other":9007199254740997}`,
+		},
+		{
+			name: "whole-object variable",
+			browserMessage: `{"type":"subscribe","id":"1","payload":{"query":"subscription S($cursor: chat_message_stream_cursor_value_input) { ` +
+				`chat_message_stream(batch_size: 10, cursor: {initial_value: $cursor}) { messageId } }",` +
+				`"variables":{"cursor":{"createdAt":"2020-01-01","id":9007199254740993}}}}`,
+			lastRow:           `{"messageId":"a","createdAt":"2020-01-02","id":9007199254740995}`,
+			expectedVariables: `{"cursor":{"createdAt":"2020-01-02","id":9007199254740995}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resumedMessage := resumeStream(t, tt.browserMessage, tt.lastRow)
+
+			if tt.expectedInlineValues != nil {
+				if values := getInlineCursorValues(t, resumedMessage.Payload.Query); !reflect.DeepEqual(values, tt.expectedInlineValues) {
+					t.Errorf("cursor values = %v, expected %v\n%s", values, tt.expectedInlineValues, resumedMessage.Payload.Query)
+				}
+			}
+
+			if tt.expectedVariables != "" {
+				if variables, _ := json.Marshal(resumedMessage.Payload.Variables); string(variables) != tt.expectedVariables {
+					t.Errorf("variables = %s, expected %s", variables, tt.expectedVariables)
+				}
+			}
+		})
+	}
+}
+
+func TestResumeStreamCursorEscapingStrings(t *testing.T) {
+	browserMessage := `{"type":"subscribe","id":"1","payload":{"query":"subscription S { chat_message_stream(batch_size: 10, ` +
+		`cursor: {initial_value: {messageId: \"\"}}) { messageId text } }"}}`
+
+	tests := []string{
+		`quote " and backslash \ and slash /`,
+		"line\nbreak\r\ttab",
+		"bell \a vertical tab \v backspace \b form feed \f escape \x1b null \x00",
+		"unicode é 😀  ",
+	}
+
+	for _, lastValue := range tests {
+		t.Run(lastValue, func(t *testing.T) {
+			lastRow, _ := json.Marshal(map[string]string{"messageId": lastValue})
+			resumedMessage := resumeStream(t, browserMessage, string(lastRow))
+
+			for _, invalidEscape := range []string{`\x`, `\a`, `\v`, `\U`} {
+				if strings.Contains(resumedMessage.Payload.Query, invalidEscape) {
+					t.Errorf("query contains the escape %s, invalid in GraphQL: %s", invalidEscape, resumedMessage.Payload.Query)
+				}
+			}
+
+			if values := getInlineCursorValues(t, resumedMessage.Payload.Query); values["messageId"] != lastValue {
+				t.Errorf("cursor value = %q, expected %q\n%s", values["messageId"], lastValue, resumedMessage.Payload.Query)
+			}
+		})
+	}
+}
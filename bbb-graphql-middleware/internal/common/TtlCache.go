@@ -0,0 +1,79 @@
+package common
+
+import (
+	"sync"
+	"time"
+)
+
+// TtlCache stores values for a fixed period, expired entries are ignored on Get and swept on Store (at most once per ttl)
+type TtlCache[V any] struct {
+	ttl         time.Duration
+	entries     map[string]ttlCacheEntry[V]
+	lastSweepAt time.Time
+	mutex       sync.RWMutex
+}
+
+type ttlCacheEntry[V any] struct {
+	value     V
+	expiresAt time.Time
+}
+
+func NewTtlCache[V any](ttl time.Duration) *TtlCache[V] {
+	return &TtlCache[V]{
+		ttl:     ttl,
+		entries: make(map[string]ttlCacheEntry[V]),
+	}
+}
+
+func (c *TtlCache[V]) Enabled() bool {
+	return c.ttl > 0
+}
+
+func (c *TtlCache[V]) Get(key string) (V, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	entry, exists := c.entries[key]
+	if !exists || time.Now().After(entry.expiresAt) {
+		var empty V
+		return empty, false
+	}
+
+	return entry.value, true
+}
+
+func (c *TtlCache[V]) Store(key string, value V) {
+	if !c.Enabled() {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.lastSweepAt) > c.ttl {
+		for existingKey, entry := range c.entries {
+			if now.After(entry.expiresAt) {
+				delete(c.entries, existingKey)
+			}
+		}
+		c.lastSweepAt = now
+	}
+
+	c.entries[key] = ttlCacheEntry[V]{
+		value:     value,
+		expiresAt: now.Add(c.ttl),
+	}
+}
+
+// DeleteFunc removes all entries for which shouldDelete returns true
+func (c *TtlCache[V]) DeleteFunc(shouldDelete func(key string, value V) bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for key, entry := range c.entries {
+		if shouldDelete(key, entry.value) {
+			delete(c.entries, key)
+		}
+	}
+}
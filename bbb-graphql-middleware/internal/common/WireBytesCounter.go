@@ -0,0 +1,39 @@
+package common
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Websocket connections whose bytes are counted
+const (
+	WsConnectionBrowser = "browser"
+	WsConnectionHasura  = "hasura"
+)
+
+// WireBytesCounter counts the bytes written to and read from the network by the websocket connections
+// (the size of the messages after compression and framing), reported as the totals of the connection type
+type WireBytesCounter struct {
+	sentCounter     prometheus.Counter
+	receivedCounter prometheus.Counter
+}
+
+// NewWireBytesCounter creates the counter of the connections of a type (browser or hasura)
+func NewWireBytesCounter(connection string) *WireBytesCounter {
+	return &WireBytesCounter{
+		sentCounter:     WsBytesCounter.With(prometheus.Labels{"connection": connection, "direction": "sent", "type": "wire"}),
+		receivedCounter: WsBytesCounter.With(prometheus.Labels{"connection": connection, "direction": "received", "type": "wire"}),
+	}
+}
+
+func (c *WireBytesCounter) AddSent(n int) {
+	c.sentCounter.Add(float64(n))
+}
+
+func (c *WireBytesCounter) AddReceived(n int) {
+	c.receivedCounter.Add(float64(n))
+}
+
+// AddRawBytes counts the size of the messages before compression
+func AddRawBytes(connection string, direction string, n int) {
+	WsBytesCounter.With(prometheus.Labels{"connection": connection, "direction": direction, "type": "raw"}).Add(float64(n))
+}
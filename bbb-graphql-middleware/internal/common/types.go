@@ -7,9 +7,10 @@ import (
 	"sync"
 	"time"
 
+	"bbb-graphql-middleware/config"
+
 	"github.com/coder/websocket"
 	"github.com/sirupsen/logrus"
-	"golang.org/x/time/rate"
 )
 
 type QueryType string
@@ -22,18 +23,40 @@ const (
 	Mutation              QueryType = "mutation"
 )
 
+// DiffFormat is the format of the changes sent to the browser instead of the full data of a subscription
+type DiffFormat string
+
+const (
+	DiffFormatJsonPatch  DiffFormat = "json-patch"  // RFC 6902, in payload.data.patch
+	DiffFormatMergePatch DiffFormat = "merge-patch" // RFC 7386, in payload.data.mergePatch
+	DiffFormatKeyedDelta DiffFormat = "keyed-delta" // items upserted/deleted by id, in payload.data.delta
+)
+
+// RateLimiter is satisfied by *rate.Limiter and by the Redis-backed limiters shared among middleware instances
+type RateLimiter interface {
+	Wait(ctx context.Context) error
+}
+
+// StreamCursorField is a field of the initial_value of the cursor of a streaming subscription
+type StreamCursorField struct {
+	Name         string // column of the cursor
+	VariableName string // variable that sets its value (empty when it's inline in the query)
+	VariableKey  string // key of the field when the variable sets the whole initial_value
+	ValueKind    string // kind of the inline value (StringValue, IntValue, EnumValue...), to write the new values alike
+}
+
 type GraphQlSubscription struct {
 	Id                         string
 	Message                    []byte
 	Type                       QueryType
 	OperationName              string
-	StreamCursorField          string
-	StreamCursorVariableName   string
-	StreamCursorCurrValue      interface{}
+	StreamCursorFields         []StreamCursorField    // fields of the cursor initial_value (streaming subscriptions)
+	StreamCursorCurrValues     map[string]interface{} // value of each cursor field in the last row received (or the initial value)
 	LastReceivedData           HasuraMessage
-	LastReceivedDataChecksum   uint32
-	JsonPatchSupported         bool   // indicate if client support Json Patch for this subscription
-	LastSeenOnHasuraConnection string // id of the hasura connection that this query was active
+	LastReceivedDataChecksum   uint64
+	JsonPatchSupported         bool       // indicate if client support Json Patch for this subscription
+	DiffFormat                 DiffFormat // format of the patches expected by the client (when JsonPatchSupported)
+	LastSeenOnHasuraConnection string     // id of the hasura connection that this query was active
 }
 
 type BrowserConnection struct {
@@ -49,8 +72,12 @@ type BrowserConnection struct {
 	Context                            context.Context    // browser connection context
 	ContextCancelFunc                  context.CancelFunc // function to cancel the browser context (and so, the browser connection)
 	BrowserRequestCookies              []*http.Cookie
+	Origin                             string                         // host of the request Origin header
+	OriginPolicy                       config.OriginPolicy            // policy of the authorized origin (authorized_cross_origins)
 	ActiveSubscriptions                map[string]GraphQlSubscription // active subscriptions of this connection (start, but no stop)
 	ActiveSubscriptionsMutex           sync.RWMutex                   // mutex to control the map usage
+	SubscriptionsDataMutex             sync.Mutex                     // mutex to update the last data of the subscriptions and create their patches
+	SubscriptionsSendMutex             sync.Mutex                     // mutex to send the data of the subscriptions in order (changes from Hasura and resyncs)
 	ActiveStreamings                   map[string][]string            // active streamings managed by Middleware of this connection
 	ActiveStreamingsMutex              sync.RWMutex                   // mutex to control the map usage
 	ConnectionInitMessage              []byte                         // init message received in this connection (to be used on hasura reconnect)
@@ -60,10 +87,12 @@ type BrowserConnection struct {
 	GraphqlActionsContext              context.Context                // graphql actions context
 	GraphqlActionsContextCancel        context.CancelFunc             // function to cancel the graphql actions context
 	FromBrowserToHasuraChannel         *SafeChannelByte               // channel to transmit messages from Browser to Hasura
-	FromBrowserToHasuraRateLimiter     *rate.Limiter                  // rate limiter to transmit messages from Browser to Hasura
-	FromBrowserToGqlActionsChannel     *SafeChannelByte               // channel to transmit messages from Browser to Graphq-Actions
-	FromBrowserToGqlActionsRateLimiter *rate.Limiter                  // rate limiter to transmit messages from Browser to Graphq-Actions
+	FromBrowserToHasuraRateLimiter     RateLimiter                    // rate limiter to transmit messages from Browser to Hasura
+	FromBrowserToGqlActionsChannels    map[string]*SafeChannelByte    // channels to transmit messages from Browser to Graphq-Actions (one per priority lane)
+	FromBrowserToGqlActionsRateLimiter RateLimiter                    // rate limiter to transmit messages from Browser to Graphq-Actions
 	FromHasuraToBrowserChannel         *SafeChannelByte               // channel to transmit messages from Hasura/GqlActions to Browser
+	OperationRateLimiters              map[string]RateLimiter         // rate limiters of the operations with a specific policy (operation_policies) and of the priority lanes
+	OperationRateLimitersMutex         sync.Mutex                     // mutex to control the map usage
 	LastBrowserMessageTime             time.Time                      // stores the time of the last message to control browser idleness
 	Logger                             *logrus.Entry                  // connection logger populated with connection info
 }
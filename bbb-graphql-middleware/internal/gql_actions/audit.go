@@ -0,0 +1,57 @@
+package gql_actions
+
+import (
+	"errors"
+	"time"
+
+	"bbb-graphql-middleware/internal/audit"
+	"bbb-graphql-middleware/internal/common"
+)
+
+// auditMutation records the mutation in the audit log when its action is audited (config audit)
+func auditMutation(
+	browserConnection *common.BrowserConnection,
+	upstream string,
+	actionName string,
+	operationName string,
+	inputs map[string]interface{},
+	receivedAt time.Time,
+	outcome string,
+	statusCode int,
+	err error,
+) {
+	if !audit.IsAudited(actionName) {
+		return
+	}
+
+	browserConnection.RLock()
+	record := audit.Record{
+		Time:                receivedAt,
+		Action:              actionName,
+		OperationName:       operationName,
+		Upstream:            upstream,
+		Inputs:              inputs,
+		MeetingId:           browserConnection.MeetingId,
+		UserId:              browserConnection.UserId,
+		SessionVariables:    browserConnection.BBBWebSessionVariables,
+		BrowserConnectionId: browserConnection.Id,
+		Outcome:             outcome,
+		StatusCode:          statusCode,
+		DurationMs:          time.Since(receivedAt).Milliseconds(),
+	}
+	browserConnection.RUnlock()
+
+	if err != nil {
+		record.Error = err.Error()
+	}
+
+	audit.Write(record)
+}
+
+func getErrorStatusCode(err error) int {
+	var gqlActionsError *GqlActionsError
+	if errors.As(err, &gqlActionsError) {
+		return gqlActionsError.StatusCode
+	}
+	return 0
+}
@@ -4,28 +4,51 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
-	"net/http"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
-	"bbb-graphql-middleware/config"
+	"bbb-graphql-middleware/internal/audit"
 	"bbb-graphql-middleware/internal/common"
 
+	"github.com/graphql-go/graphql/language/ast"
 	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 )
 
-var graphqlActionsUrl = config.GetConfig().GraphqlActions.Url
-
 func GraphqlActionsClient(
 	browserConnection *common.BrowserConnection,
 ) error {
 	browserConnection.Logger.Debug("Starting GraphqlActionsClient")
 	defer browserConnection.Logger.Debug("Finished GraphqlActionsClient")
 
+	// Each priority lane is processed by its own routine, so control mutations are never queued behind the others
+	var wg sync.WaitGroup
+	for _, lane := range PriorityLanes {
+		wg.Add(1)
+		go func(lane string) {
+			defer wg.Done()
+			processLaneMutations(browserConnection, lane)
+		}(lane)
+	}
+	wg.Wait()
+
+	return nil
+}
+
+func processLaneMutations(browserConnection *common.BrowserConnection, lane string) {
+	laneChannel := browserConnection.FromBrowserToGqlActionsChannels[lane]
+
+	// Mutations with a rule in config coalescing_rules wait for their window before being sent
+	coalescer := newMutationsCoalescer()
+	defer flushPendingMutations(browserConnection, coalescer)
+
+	// Mutations repeated within the window of config dedupe_windows receive the response of the first one
+	deduplicator := newMutationsDeduplicator()
+
 RangeLoop:
 	for {
 		select {
@@ -34,7 +57,11 @@ RangeLoop:
 		case <-browserConnection.GraphqlActionsContext.Done():
 			browserConnection.Logger.Debug("GraphqlActionsContext cancelled!")
 			break RangeLoop
-		case fromBrowserMessage := <-browserConnection.FromBrowserToGqlActionsChannel.ReceiveChannel():
+		case <-coalescer.timerChannel():
+			for _, group := range coalescer.popDueGroups() {
+				sendCoalescedMutations(browserConnection.Context, browserConnection, group)
+			}
+		case fromBrowserMessage := <-laneChannel.ReceiveChannel():
 			{
 				if fromBrowserMessage == nil {
 					continue
@@ -48,82 +75,203 @@ RangeLoop:
 				}
 
 				if browserMessage.Type == "subscribe" {
+					receivedAt := time.Now()
 					var mutationFuncName string
+					var mutationInputs map[string]interface{}
+
+					// Cached by the browser reader, that parsed it to pick the lane
+					parsedOperation := common.GetParsedOperation(browserMessage.Payload.Query, browserMessage.Payload.OperationName)
+					isMutation := parsedOperation.Type == ast.OperationTypeMutation
+					if isMutation {
+						funcName, inputs, err := parseGraphQLMutation(parsedOperation.RootFieldName, browserMessage.Payload.Query, browserMessage.Payload.Variables)
+						if err != nil {
+							sendErrorMessage(browserConnection, browserMessage.ID, fmt.Sprintf("It was not able to parse graphQL query: %s", err.Error()))
+							continue
+						}
+						mutationFuncName = funcName
+						mutationInputs = inputs
+					}
 
-					if config.GetConfig().Server.MaxMutationLength > 0 {
+					// Limits from config operation_policies (or the lane/connection limits when the action has no policy)
+					policy := getLaneMutationPolicy(browserConnection, lane, mutationFuncName, browserMessage.Payload.OperationName)
+
+					if policy.MaxLength > 0 {
 						mutationLength := len(browserMessage.Payload.Query)
-						if mutationLength > config.GetConfig().Server.MaxMutationLength {
+						if mutationLength > policy.MaxLength {
+							policy.Reject("max_length")
+							auditMutation(browserConnection, MutationUpstreamGraphqlActions, mutationFuncName, browserMessage.Payload.OperationName, mutationInputs, receivedAt, audit.OutcomeRejected, 0, fmt.Errorf("max_length"))
 							sendErrorMessage(
 								browserConnection,
 								browserMessage.ID,
 								fmt.Sprintf(
 									"Mutation %s is not valid with length %d and the max allowed is %d",
 									browserMessage.Payload.OperationName,
-									mutationLength, config.GetConfig().Server.MaxMutationLength))
+									mutationLength, policy.MaxLength))
+							continue
+						}
+					}
+
+					if policy.MaxDepth > 0 {
+						mutationDepth := parsedOperation.Depth
+						if mutationDepth > policy.MaxDepth {
+							policy.Reject("max_depth")
+							auditMutation(browserConnection, MutationUpstreamGraphqlActions, mutationFuncName, browserMessage.Payload.OperationName, mutationInputs, receivedAt, audit.OutcomeRejected, 0, fmt.Errorf("max_depth"))
+							sendErrorMessage(
+								browserConnection,
+								browserMessage.ID,
+								fmt.Sprintf(
+									"Mutation %s is not valid with depth %d and the max allowed is %d",
+									browserMessage.Payload.OperationName,
+									mutationDepth, policy.MaxDepth))
 							continue
 						}
 					}
 
 					// Rate limiter from config max_connection_mutations_per_minute
-					ctxRateLimiter, _ := context.WithTimeout(browserConnection.Context, 30*time.Second)
-					if err := browserConnection.FromBrowserToGqlActionsRateLimiter.Wait(ctxRateLimiter); err != nil {
+					ctxRateLimiter, cancelCtxRateLimiter := context.WithTimeout(browserConnection.Context, 30*time.Second)
+					errRateLimiter := policy.RateLimiter.Wait(ctxRateLimiter)
+					cancelCtxRateLimiter()
+					if errRateLimiter != nil {
+						policy.Reject("rate_limit")
+						auditMutation(browserConnection, MutationUpstreamGraphqlActions, mutationFuncName, browserMessage.Payload.OperationName, mutationInputs, receivedAt, audit.OutcomeRejected, 0, fmt.Errorf("rate_limit"))
 						sendErrorMessage(
 							browserConnection,
 							browserMessage.ID,
-							fmt.Sprintf("Rate limit exceeded: Maximum %d mutations per minute allowed. Please try again later.", config.GetConfig().Server.MaxConnectionMutationsPerMinute),
+							fmt.Sprintf("Rate limit exceeded: Maximum %d mutations per minute allowed. Please try again later.", policy.RatePerMinute),
 						)
 
 						continue
 					}
 
-					if strings.HasPrefix(browserMessage.Payload.Query, "mutation") {
-						if funcName, inputs, err := parseGraphQLMutation(browserMessage.Payload.Query, browserMessage.Payload.Variables); err == nil {
-							mutationFuncName = funcName
-							if err = SendGqlActionsRequest(funcName, inputs, browserConnection.BBBWebSessionVariables, browserConnection.Logger); err == nil {
-								// Add Prometheus Metrics
-								common.GqlMutationsCounter.With(prometheus.Labels{"operationName": browserMessage.Payload.OperationName}).Inc()
+					var actionResponse GqlActionsResponse
+					if isMutation && GetMutationUpstream(mutationFuncName) == MutationUpstreamHasura {
+						// Send the pending coalesced mutations first, to keep the order of the client
+						for _, group := range coalescer.popAllGroups() {
+							sendCoalescedMutations(browserConnection.Context, browserConnection, group)
+						}
+
+						// The response will be sent by Hasura (through the hasura connection of the browser)
+						// The mark lets the hasura writer know the mutation limits were already applied
+						if !browserConnection.FromBrowserToHasuraChannel.SendWait(browserConnection.Context, common.MarkAsForwardedMutation(fromBrowserMessage)) {
+							sendErrorMessage(browserConnection, browserMessage.ID, "It was not able to send the mutation to Hasura")
+							auditMutation(browserConnection, MutationUpstreamHasura, mutationFuncName, browserMessage.Payload.OperationName, mutationInputs, receivedAt, audit.OutcomeError, 0, fmt.Errorf("hasura channel closed"))
+							continue
+						}
+						common.GqlMutationsCounter.With(prometheus.Labels{"operationName": browserMessage.Payload.OperationName}).Inc()
+						auditMutation(browserConnection, MutationUpstreamHasura, mutationFuncName, browserMessage.Payload.OperationName, mutationInputs, receivedAt, audit.OutcomeForwarded, 0, nil)
+						continue
+					}
+
+					if isMutation {
+						// Interceptors from config graphql-actions.interceptors can change the inputs, reject or answer the mutation
+						mutation := &MutationContext{
+							ActionName:        mutationFuncName,
+							OperationName:     browserMessage.Payload.OperationName,
+							Inputs:            mutationInputs,
+							SessionVariables:  browserConnection.BBBWebSessionVariables,
+							BrowserConnection: browserConnection,
+							Logger:            browserConnection.Logger.WithField("funcName", mutationFuncName),
+						}
+						interceptedResponse, err := runInterceptors(mutation)
+						if err != nil {
+							auditMutation(browserConnection, MutationUpstreamGraphqlActions, mutationFuncName, browserMessage.Payload.OperationName, mutation.Inputs, receivedAt, audit.OutcomeRejected, 0, err)
+							var gqlActionsError *GqlActionsError
+							if errors.As(err, &gqlActionsError) && gqlActionsError.Errors != nil {
+								sendGraphqlErrors(browserConnection, browserMessage.ID, gqlActionsError.Errors)
+							} else {
+								sendErrorMessage(browserConnection, browserMessage.ID, err.Error())
+							}
+							continue
+						}
+						if interceptedResponse != nil {
+							auditMutation(browserConnection, MutationUpstreamGraphqlActions, mutationFuncName, browserMessage.Payload.OperationName, mutation.Inputs, receivedAt, audit.OutcomeResponded, 0, nil)
+							sendActionResponse(browserConnection, browserMessage.ID, mutationFuncName, *interceptedResponse)
+							continue
+						}
+						mutationInputs = mutation.Inputs
+
+						// Mutations repeated within the window of config dedupe_windows receive the response of the first one
+						// (checked with the inputs rewritten by the interceptors)
+						if duplicateResponse, isDuplicate := deduplicator.getDuplicateResponse(mutationFuncName, mutationInputs); isDuplicate {
+							browserConnection.Logger.Debugf("Duplicated mutation %s answered without being sent", mutationFuncName)
+							common.GqlActionsDuplicatesCounter.With(prometheus.Labels{"action": mutationFuncName}).Inc()
+							sendActionResponse(browserConnection, browserMessage.ID, mutationFuncName, duplicateResponse)
+							continue
+						}
+
+						if rule, hasRule := getCoalescingRule(mutationFuncName); hasRule {
+							readyGroup := coalescer.add(mutationFuncName, rule, pendingMutation{
+								messageId:     browserMessage.ID,
+								operationName: browserMessage.Payload.OperationName,
+								inputs:        mutationInputs,
+								receivedAt:    receivedAt,
+							})
+							if readyGroup != nil {
+								sendCoalescedMutations(browserConnection.Context, browserConnection, readyGroup)
+							}
+							continue
+						}
+
+						// Send the pending coalesced mutations first, to keep the order of the client
+						for _, group := range coalescer.popAllGroups() {
+							sendCoalescedMutations(browserConnection.Context, browserConnection, group)
+						}
+
+						if actionResponse, err = SendGqlActionsRequest(
+							browserConnection.Context,
+							mutationFuncName,
+							mutationInputs,
+							browserConnection.BBBWebSessionVariables,
+							GetIdempotencyKey(browserConnection, browserMessage.ID),
+							browserConnection.Logger,
+						); err == nil {
+							// Add Prometheus Metrics
+							common.GqlMutationsCounter.With(prometheus.Labels{"operationName": browserMessage.Payload.OperationName}).Inc()
+							auditMutation(browserConnection, MutationUpstreamGraphqlActions, mutationFuncName, browserMessage.Payload.OperationName, mutationInputs, receivedAt, audit.OutcomeSuccess, actionResponse.StatusCode, nil)
+							deduplicator.recordResponse(mutationFuncName, mutationInputs, actionResponse)
+						} else {
+							auditMutation(browserConnection, MutationUpstreamGraphqlActions, mutationFuncName, browserMessage.Payload.OperationName, mutationInputs, receivedAt, audit.OutcomeError, getErrorStatusCode(err), err)
+							var gqlActionsError *GqlActionsError
+							if errors.As(err, &gqlActionsError) && gqlActionsError.Errors != nil {
+								sendGraphqlErrors(browserConnection, browserMessage.ID, gqlActionsError.Errors)
 							} else {
 								sendErrorMessage(browserConnection, browserMessage.ID, fmt.Sprintf("It was not able to send the request to Graphql Actions: %s", err.Error()))
-								continue
 							}
-						} else {
-							sendErrorMessage(browserConnection, browserMessage.ID, fmt.Sprintf("It was not able to parse graphQL query: %s", err.Error()))
 							continue
 						}
 					}
 
 					// Action sent successfully, return data msg to client
-					browserResponseData := map[string]interface{}{
-						"id":   browserMessage.ID,
-						"type": "next",
-						"payload": map[string]interface{}{
-							"data": map[string]interface{}{
-								mutationFuncName: true,
-							},
-						},
-					}
-					jsonDataNext, _ := json.Marshal(browserResponseData)
-					browserConnection.FromHasuraToBrowserChannel.SendWait(browserConnection.Context, jsonDataNext)
-
-					// Return complete msg to client
-					browserResponseComplete := map[string]interface{}{
-						"id":   browserMessage.ID,
-						"type": "complete",
-					}
-					jsonDataComplete, _ := json.Marshal(browserResponseComplete)
-					browserConnection.FromHasuraToBrowserChannel.SendWait(browserConnection.Context, jsonDataComplete)
+					sendActionResponse(browserConnection, browserMessage.ID, mutationFuncName, actionResponse)
 				}
-
-				// Fallback to Hasura was disabled (keeping the code temporarily)
-				// fromBrowserToHasuraChannel.Send(fromBrowserMessage)
 			}
 		}
 	}
+}
 
-	return nil
+// flushPendingMutations sends the coalesced mutations still waiting when the connection is closed
+func flushPendingMutations(browserConnection *common.BrowserConnection, coalescer *mutationsCoalescer) {
+	pendingGroups := coalescer.popAllGroups()
+	if len(pendingGroups) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, group := range pendingGroups {
+		sendCoalescedMutations(ctx, browserConnection, group)
+	}
 }
 
-func SendGqlActionsRequest(funcName string, inputs map[string]interface{}, sessionVariables map[string]string, bcLogger *log.Entry) error {
+func SendGqlActionsRequest(
+	ctx context.Context,
+	funcName string,
+	inputs map[string]interface{},
+	sessionVariables map[string]string,
+	idempotencyKey string,
+	bcLogger *log.Entry,
+) (GqlActionsResponse, error) {
 	logger := bcLogger.WithField("funcName", funcName).WithField("inputs", inputs)
 
 	data := GqlActionsRequestBody{
@@ -134,81 +282,89 @@ func SendGqlActionsRequest(funcName string, inputs map[string]interface{}, sessi
 		SessionVariables: sessionVariables,
 	}
 
-	if funcName == "userSetConnectionAlive" {
-		if traceLog, traceLogExists := inputs["traceLog"]; traceLogExists && traceLog != "" {
-			meetingId := sessionVariables["x-hasura-meetingid"]
-			userId := sessionVariables["x-hasura-userid"]
-			logger.Infof("Received %s meetingId=%s userId=%s", traceLog, meetingId, userId)
+	return getMutationSink().Send(ctx, data, idempotencyKey, logger)
+}
 
-			now := time.Now().UTC()
-			data.Input["traceLog"] = fmt.Sprintf("%s@gqlmiddleware|%s", traceLog, now.Format("2006-01-02T15:04:05.000Z"))
-		}
-	}
+type GqlActionsRequestBody struct {
+	Action           GqlActionsAction       `json:"action"`
+	Input            map[string]interface{} `json:"input"`
+	SessionVariables map[string]string      `json:"session_variables"`
+}
 
-	jsonData, err := json.Marshal(data)
-	if err != nil {
-		return err
-	}
+type GqlActionsAction struct {
+	Name string `json:"name"`
+}
 
-	if graphqlActionsUrl == "" {
-		return fmt.Errorf("No Graphql Actions Url (BBB_GRAPHQL_MIDDLEWARE_GRAPHQL_ACTIONS_URL) set, aborting")
-	}
+// GetIdempotencyKey returns the key that identifies a mutation sent by the client (the same for all its retries)
+func GetIdempotencyKey(browserConnection *common.BrowserConnection, messageId string) string {
+	return common.GetUniqueID() + ":" + browserConnection.Id + ":" + messageId
+}
 
-	startedAt := time.Now()
+// GqlActionsResponse is the result of an action
+// Data is nil when the action doesn't return anything (or just `true`)
+type GqlActionsResponse struct {
+	Data       json.RawMessage
+	Errors     json.RawMessage
+	StatusCode int // status code returned by graphql-actions (0 when the mutation was not sent)
+}
 
-	response, err := http.Post(graphqlActionsUrl, "application/json", bytes.NewBuffer(jsonData))
-	if err != nil {
-		return err
-	}
-	defer response.Body.Close()
+// GqlActionsError is returned when graphql-actions fails, Errors contains the GraphQL-style errors it returned
+type GqlActionsError struct {
+	Message    string
+	StatusCode int
+	Errors     json.RawMessage
+}
 
-	totalDurationMillis := time.Since(startedAt).Milliseconds()
-	logger = logger.WithField("duration", fmt.Sprintf("%v ms", totalDurationMillis)).WithField("statusCode", response.StatusCode)
+func (e *GqlActionsError) Error() string {
+	return fmt.Sprintf("graphql actions request failed: %s", e.Message)
+}
 
-	logger.Tracef("Executed!")
-	if totalDurationMillis > 100 {
-		logger.Infof("Took too long to execute!")
+// parseGqlActionsResponse reads the body returned by graphql-actions, that can be:
+// empty, `true` or `null` (action doesn't return anything);
+// a GraphQL-style response `{"data": ..., "errors": [...]}`;
+// or any other JSON value, considered the data returned by the action
+func parseGqlActionsResponse(body []byte) GqlActionsResponse {
+	trimmedBody := bytes.TrimSpace(body)
+	if len(trimmedBody) == 0 || bytes.Equal(trimmedBody, []byte("true")) || bytes.Equal(trimmedBody, []byte("null")) {
+		return GqlActionsResponse{}
 	}
 
-	if response.StatusCode != 200 {
-		body, err := ioutil.ReadAll(response.Body)
-		if err != nil {
-			fmt.Println("Error reading response body:", err)
+	var bodyAsMap map[string]json.RawMessage
+	if err := json.Unmarshal(trimmedBody, &bodyAsMap); err == nil {
+		_, existsData := bodyAsMap["data"]
+		_, existsErrors := bodyAsMap["errors"]
+		isGraphqlResponse := existsData || existsErrors
+		for key := range bodyAsMap {
+			if key != "data" && key != "errors" && key != "extensions" {
+				isGraphqlResponse = false
+				break
+			}
 		}
 
-		var result map[string]interface{}
-		err = json.Unmarshal(body, &result)
-		if err == nil {
-			if message, ok := result["message"].(string); ok {
-				logger.Errorf(string(jsonData), message, err)
-				return fmt.Errorf("graphql actions request failed: %s", message)
+		if isGraphqlResponse {
+			response := GqlActionsResponse{
+				Data:   bodyAsMap["data"],
+				Errors: bodyAsMap["errors"],
+			}
+			if bytes.Equal(response.Data, []byte("true")) || bytes.Equal(response.Data, []byte("null")) {
+				response.Data = nil
 			}
+			return response
 		}
-
-		return fmt.Errorf("graphql actions request failed: %s", response.Status)
 	}
 
-	return nil
-}
-
-type GqlActionsRequestBody struct {
-	Action           GqlActionsAction       `json:"action"`
-	Input            map[string]interface{} `json:"input"`
-	SessionVariables map[string]string      `json:"session_variables"`
-}
+	if !json.Valid(trimmedBody) {
+		return GqlActionsResponse{}
+	}
 
-type GqlActionsAction struct {
-	Name string `json:"name"`
+	return GqlActionsResponse{Data: trimmedBody}
 }
 
-func parseGraphQLMutation(query string, variables map[string]interface{}) (string, map[string]interface{}, error) {
-	// Extract the function name from the query
-	reFuncName := regexp.MustCompile(`\{\s*(\w+)`)
-	funcNameMatch := reFuncName.FindStringSubmatch(query)
-	if len(funcNameMatch) < 2 {
+func parseGraphQLMutation(funcName string, query string, variables map[string]interface{}) (string, map[string]interface{}, error) {
+	// The function name is the root field of the parsed mutation
+	if funcName == "" {
 		return "", nil, fmt.Errorf("failed to extract function name from query")
 	}
-	funcName := funcNameMatch[1]
 
 	// Prepare to extract and parse parameters
 	queryParams := make(map[string]interface{})
@@ -244,8 +400,68 @@ func parseGraphQLMutation(query string, variables map[string]interface{}) (strin
 	return funcName, queryParams, nil
 }
 
+func sendActionResponse(browserConnection *common.BrowserConnection, messageId string, mutationFuncName string, actionResponse GqlActionsResponse) {
+	// Actions that don't return anything are answered with `true`, and with `null` when they failed
+	var actionData interface{} = true
+	if actionResponse.Data != nil {
+		actionData = actionResponse.Data
+	} else if actionResponse.Errors != nil {
+		actionData = nil
+	}
+
+	browserResponsePayload := map[string]interface{}{
+		"data": map[string]interface{}{
+			mutationFuncName: actionData,
+		},
+	}
+	if actionResponse.Errors != nil {
+		browserResponsePayload["errors"] = actionResponse.Errors
+	}
+
+	browserResponseData := map[string]interface{}{
+		"id":      messageId,
+		"type":    "next",
+		"payload": browserResponsePayload,
+	}
+	jsonDataNext, _ := json.Marshal(browserResponseData)
+	browserConnection.FromHasuraToBrowserChannel.SendWait(browserConnection.Context, jsonDataNext)
+
+	// Return complete msg to client
+	browserResponseComplete := map[string]interface{}{
+		"id":   messageId,
+		"type": "complete",
+	}
+	jsonDataComplete, _ := json.Marshal(browserResponseComplete)
+	browserConnection.FromHasuraToBrowserChannel.SendWait(browserConnection.Context, jsonDataComplete)
+}
+
+// sendGraphqlErrors forwards to the client the errors (with their extensions) returned by graphql-actions
+func sendGraphqlErrors(browserConnection *common.BrowserConnection, messageId string, graphqlErrors json.RawMessage) {
+	browserConnection.Logger.Errorf("Graphql Actions returned errors: %s", string(graphqlErrors))
+
+	if !bytes.HasPrefix(bytes.TrimSpace(graphqlErrors), []byte("[")) {
+		graphqlErrors = append(append([]byte("["), graphqlErrors...), ']')
+	}
+
+	browserResponseData := map[string]interface{}{
+		"id":      messageId,
+		"type":    "error",
+		"payload": graphqlErrors,
+	}
+	jsonDataError, _ := json.Marshal(browserResponseData)
+	browserConnection.FromHasuraToBrowserChannel.SendWait(browserConnection.Context, jsonDataError)
+
+	// Return complete msg to client
+	browserResponseComplete := map[string]interface{}{
+		"id":   messageId,
+		"type": "complete",
+	}
+	jsonDataComplete, _ := json.Marshal(browserResponseComplete)
+	browserConnection.FromHasuraToBrowserChannel.SendWait(browserConnection.Context, jsonDataComplete)
+}
+
 func sendErrorMessage(browserConnection *common.BrowserConnection, messageId string, errorMessage string) {
-	browserConnection.Logger.Errorf(errorMessage)
+	browserConnection.Logger.Error(errorMessage)
 
 	// Error on sending action, return error msg to client
 	browserResponseData := map[string]interface{}{
@@ -0,0 +1,200 @@
+package gql_actions
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"bbb-graphql-middleware/config"
+	"bbb-graphql-middleware/internal/audit"
+	"bbb-graphql-middleware/internal/common"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	CoalescingModeLatestWins = "latest_wins"
+	CoalescingModeBatch      = "batch"
+)
+
+var coalescingRules = config.GetConfig().GraphqlActions.CoalescingRules
+
+// pendingMutation is a mutation received from the browser that is waiting for its coalescing window
+type pendingMutation struct {
+	messageId     string
+	operationName string
+	inputs        map[string]interface{}
+	receivedAt    time.Time
+}
+
+// coalescingGroup contains the pending mutations of an action, that will be sent in a single request
+type coalescingGroup struct {
+	actionName string
+	rule       config.CoalescingRule
+	mutations  []pendingMutation
+	flushAt    time.Time
+}
+
+// mutationsCoalescer holds the coalescing groups of a browser connection (used only by GraphqlActionsClient routine)
+type mutationsCoalescer struct {
+	groups map[string]*coalescingGroup
+	timer  *time.Timer
+	timerC <-chan time.Time
+}
+
+func newMutationsCoalescer() *mutationsCoalescer {
+	return &mutationsCoalescer{
+		groups: make(map[string]*coalescingGroup),
+	}
+}
+
+func getCoalescingRule(actionName string) (config.CoalescingRule, bool) {
+	rule, exists := coalescingRules[actionName]
+	if !exists || rule.WindowMs <= 0 || (rule.Mode != CoalescingModeLatestWins && rule.Mode != CoalescingModeBatch) {
+		return config.CoalescingRule{}, false
+	}
+	return rule, true
+}
+
+// add appends the mutation to the group of its action, returning the group when it reached max_batch_size
+func (c *mutationsCoalescer) add(actionName string, rule config.CoalescingRule, mutation pendingMutation) *coalescingGroup {
+	group, exists := c.groups[actionName]
+	if !exists {
+		group = &coalescingGroup{
+			actionName: actionName,
+			rule:       rule,
+			flushAt:    time.Now().Add(time.Duration(rule.WindowMs) * time.Millisecond),
+		}
+		c.groups[actionName] = group
+	}
+	group.mutations = append(group.mutations, mutation)
+
+	if rule.MaxBatchSize > 0 && len(group.mutations) >= rule.MaxBatchSize {
+		delete(c.groups, actionName)
+		c.resetTimer()
+		return group
+	}
+
+	if !exists {
+		c.resetTimer()
+	}
+	return nil
+}
+
+// timerChannel fires when the window of the oldest group is over (nil when there is no pending group)
+func (c *mutationsCoalescer) timerChannel() <-chan time.Time {
+	return c.timerC
+}
+
+// popDueGroups removes and returns the groups whose window is over
+func (c *mutationsCoalescer) popDueGroups() []*coalescingGroup {
+	now := time.Now()
+	dueGroups := make([]*coalescingGroup, 0)
+	for actionName, group := range c.groups {
+		if !group.flushAt.After(now) {
+			dueGroups = append(dueGroups, group)
+			delete(c.groups, actionName)
+		}
+	}
+	c.resetTimer()
+	return dueGroups
+}
+
+// popAllGroups removes and returns all pending groups
+func (c *mutationsCoalescer) popAllGroups() []*coalescingGroup {
+	groups := make([]*coalescingGroup, 0, len(c.groups))
+	for actionName, group := range c.groups {
+		groups = append(groups, group)
+		delete(c.groups, actionName)
+	}
+	c.resetTimer()
+	return groups
+}
+
+func (c *mutationsCoalescer) resetTimer() {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+		c.timerC = nil
+	}
+
+	var nextFlushAt time.Time
+	for _, group := range c.groups {
+		if nextFlushAt.IsZero() || group.flushAt.Before(nextFlushAt) {
+			nextFlushAt = group.flushAt
+		}
+	}
+
+	if !nextFlushAt.IsZero() {
+		c.timer = time.NewTimer(time.Until(nextFlushAt))
+		c.timerC = c.timer.C
+	}
+}
+
+// sendCoalescedMutations sends the group to graphql-actions and answers every message id of the group:
+// latest_wins sends only the inputs of the last mutation, batch sends the inputs of all of them as `{"batch": [...]}`
+func sendCoalescedMutations(ctx context.Context, browserConnection *common.BrowserConnection, group *coalescingGroup) {
+	if len(group.mutations) == 0 {
+		return
+	}
+
+	lastMutation := group.mutations[len(group.mutations)-1]
+	inputs := lastMutation.inputs
+	if group.rule.Mode == CoalescingModeBatch && len(group.mutations) > 1 {
+		batch := make([]map[string]interface{}, 0, len(group.mutations))
+		for _, mutation := range group.mutations {
+			batch = append(batch, mutation.inputs)
+		}
+		inputs = map[string]interface{}{"batch": batch}
+	}
+
+	if len(group.mutations) > 1 {
+		common.GqlActionsCoalescedCounter.With(prometheus.Labels{"action": group.actionName, "mode": group.rule.Mode}).Add(float64(len(group.mutations) - 1))
+	}
+
+	actionResponse, err := SendGqlActionsRequest(
+		ctx,
+		group.actionName,
+		inputs,
+		browserConnection.BBBWebSessionVariables,
+		GetIdempotencyKey(browserConnection, lastMutation.messageId),
+		browserConnection.Logger.WithField("coalescedMessages", len(group.mutations)),
+	)
+
+	if err != nil {
+		var gqlActionsError *GqlActionsError
+		for _, mutation := range group.mutations {
+			auditMutation(browserConnection, MutationUpstreamGraphqlActions, group.actionName, mutation.operationName, mutation.inputs, mutation.receivedAt, audit.OutcomeError, getErrorStatusCode(err), err)
+			if errors.As(err, &gqlActionsError) && gqlActionsError.Errors != nil {
+				sendGraphqlErrors(browserConnection, mutation.messageId, gqlActionsError.Errors)
+			} else {
+				sendErrorMessage(browserConnection, mutation.messageId, fmt.Sprintf("It was not able to send the request to Graphql Actions: %s", err.Error()))
+			}
+		}
+		return
+	}
+
+	// When the batch returns an array with one item per mutation, each message receives its own item
+	var batchData []json.RawMessage
+	if group.rule.Mode == CoalescingModeBatch && len(group.mutations) > 1 && actionResponse.Data != nil {
+		if json.Unmarshal(actionResponse.Data, &batchData) != nil || len(batchData) != len(group.mutations) {
+			batchData = nil
+		}
+	}
+
+	for i, mutation := range group.mutations {
+		common.GqlMutationsCounter.With(prometheus.Labels{"operationName": mutation.operationName}).Inc()
+		auditMutation(browserConnection, MutationUpstreamGraphqlActions, group.actionName, mutation.operationName, mutation.inputs, mutation.receivedAt, audit.OutcomeSuccess, actionResponse.StatusCode, nil)
+
+		mutationResponse := actionResponse
+		if batchData != nil {
+			mutationResponse.Data = batchData[i]
+			if string(mutationResponse.Data) == "null" {
+				mutationResponse.Data = nil
+			}
+		}
+		sendActionResponse(browserConnection, mutation.messageId, group.actionName, mutationResponse)
+	}
+}
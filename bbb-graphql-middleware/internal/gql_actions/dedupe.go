@@ -0,0 +1,104 @@
+package gql_actions
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"time"
+
+	"bbb-graphql-middleware/config"
+)
+
+// The window under this key (config graphql-actions.dedupe_windows) applies to the actions without their own window
+const allActionsDedupeWindowKey = "*"
+
+var dedupeWindows = config.GetConfig().GraphqlActions.DedupeWindows
+
+// Expired entries are removed at most once per dedupeSweepInterval
+var dedupeSweepInterval = 1 * time.Second
+
+// mutationsDeduplicator remembers the mutations recently executed by a connection, with their responses
+// (used only by GraphqlActionsClient routine)
+type mutationsDeduplicator struct {
+	entries   map[[sha256.Size]byte]dedupeEntry
+	lastSweep time.Time
+}
+
+type dedupeEntry struct {
+	expiresAt time.Time
+	response  GqlActionsResponse
+}
+
+func newMutationsDeduplicator() *mutationsDeduplicator {
+	return &mutationsDeduplicator{
+		entries:   make(map[[sha256.Size]byte]dedupeEntry),
+		lastSweep: time.Now(),
+	}
+}
+
+func getDedupeWindow(actionName string) time.Duration {
+	windowMs, exists := dedupeWindows[actionName]
+	if !exists {
+		windowMs = dedupeWindows[allActionsDedupeWindowKey]
+	}
+	return time.Duration(windowMs) * time.Millisecond
+}
+
+func getDedupeHash(actionName string, inputs map[string]interface{}) ([sha256.Size]byte, bool) {
+	// json.Marshal sorts the map keys, so the same inputs always produce the same hash
+	inputsAsJson, err := json.Marshal(inputs)
+	if err != nil {
+		return [sha256.Size]byte{}, false
+	}
+	return sha256.Sum256(append([]byte(actionName+"\x00"), inputsAsJson...)), true
+}
+
+// getDuplicateResponse returns the response of the same action with the same inputs, when it was executed
+// successfully within the dedupe window of the action
+func (d *mutationsDeduplicator) getDuplicateResponse(actionName string, inputs map[string]interface{}) (GqlActionsResponse, bool) {
+	if getDedupeWindow(actionName) <= 0 {
+		return GqlActionsResponse{}, false
+	}
+
+	hash, ok := getDedupeHash(actionName, inputs)
+	if !ok {
+		return GqlActionsResponse{}, false
+	}
+
+	now := time.Now()
+	d.sweep(now)
+
+	if entry, exists := d.entries[hash]; exists && now.Before(entry.expiresAt) {
+		return entry.response, true
+	}
+	return GqlActionsResponse{}, false
+}
+
+// recordResponse remembers the response of an action executed successfully, to replay it to the duplicates
+// (failed or rejected mutations are not recorded, so their retries are executed)
+func (d *mutationsDeduplicator) recordResponse(actionName string, inputs map[string]interface{}, response GqlActionsResponse) {
+	// Responses with errors are not replayed, the duplicates are executed again
+	window := getDedupeWindow(actionName)
+	if window <= 0 || response.Errors != nil {
+		return
+	}
+
+	if hash, ok := getDedupeHash(actionName, inputs); ok {
+		d.entries[hash] = dedupeEntry{
+			expiresAt: time.Now().Add(window),
+			response:  response,
+		}
+	}
+}
+
+func (d *mutationsDeduplicator) sweep(now time.Time) {
+	if now.Sub(d.lastSweep) < dedupeSweepInterval {
+		return
+	}
+	d.lastSweep = now
+
+	for hash, entry := range d.entries {
+		if !now.Before(entry.expiresAt) {
+			delete(d.entries, hash)
+		}
+	}
+}
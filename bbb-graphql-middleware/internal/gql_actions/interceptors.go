@@ -0,0 +1,231 @@
+package gql_actions
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"bbb-graphql-middleware/config"
+	"bbb-graphql-middleware/internal/common"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// Interceptors under this key (config graphql-actions.interceptors) apply to all actions, before the ones of the action
+const allActionsInterceptorsKey = "*"
+
+// MutationContext is the mutation received from the browser, passed through the interceptors before being sent
+type MutationContext struct {
+	ActionName        string
+	OperationName     string
+	Inputs            map[string]interface{}
+	SessionVariables  map[string]string
+	BrowserConnection *common.BrowserConnection
+	Logger            *log.Entry
+}
+
+// MutationInterceptor can validate or change the inputs of a mutation before it's sent to graphql-actions.
+// It returns an error to reject the mutation (the message is sent to the client, or the Errors of a *GqlActionsError),
+// or a response to answer the client without sending the mutation. Returning (nil, nil) continues the chain.
+type MutationInterceptor interface {
+	Intercept(mutation *MutationContext) (*GqlActionsResponse, error)
+}
+
+// MutationInterceptorFunc allows the use of ordinary functions as interceptors
+type MutationInterceptorFunc func(mutation *MutationContext) (*GqlActionsResponse, error)
+
+func (f MutationInterceptorFunc) Intercept(mutation *MutationContext) (*GqlActionsResponse, error) {
+	return f(mutation)
+}
+
+// MutationInterceptorFactory creates an interceptor from the options set in config
+type MutationInterceptorFactory func(options map[string]interface{}) (MutationInterceptor, error)
+
+type namedInterceptor struct {
+	name        string
+	interceptor MutationInterceptor
+}
+
+var (
+	interceptorFactories      = make(map[string]MutationInterceptorFactory)
+	interceptorFactoriesMutex sync.RWMutex
+
+	interceptorsChain     map[string][]namedInterceptor
+	interceptorsChainOnce sync.Once
+)
+
+// RegisterInterceptor makes an interceptor available to be used in config graphql-actions.interceptors
+// (it must be called before the first mutation is received)
+func RegisterInterceptor(name string, factory MutationInterceptorFactory) {
+	interceptorFactoriesMutex.Lock()
+	defer interceptorFactoriesMutex.Unlock()
+
+	interceptorFactories[name] = factory
+}
+
+func getInterceptorsChain() map[string][]namedInterceptor {
+	interceptorsChainOnce.Do(func() {
+		logger := log.WithField("_routine", "MutationInterceptors")
+
+		interceptorFactoriesMutex.RLock()
+		defer interceptorFactoriesMutex.RUnlock()
+
+		interceptorsChain = make(map[string][]namedInterceptor)
+		for actionName, interceptorsConfig := range config.GetConfig().GraphqlActions.Interceptors {
+			for _, interceptorConfig := range interceptorsConfig {
+				factory, exists := interceptorFactories[interceptorConfig.Name]
+				if !exists {
+					logger.Errorf("Interceptor %s (action %s) not found, ignoring it", interceptorConfig.Name, actionName)
+					continue
+				}
+
+				interceptor, err := factory(interceptorConfig.Options)
+				if err != nil {
+					logger.Errorf("Invalid options of interceptor %s (action %s), ignoring it: %v", interceptorConfig.Name, actionName, err)
+					continue
+				}
+
+				interceptorsChain[actionName] = append(interceptorsChain[actionName], namedInterceptor{
+					name:        interceptorConfig.Name,
+					interceptor: interceptor,
+				})
+			}
+		}
+	})
+
+	return interceptorsChain
+}
+
+// runInterceptors passes the mutation through the interceptors of all actions and then through the ones of its action
+func runInterceptors(mutation *MutationContext) (*GqlActionsResponse, error) {
+	chain := getInterceptorsChain()
+
+	for _, chainKey := range []string{allActionsInterceptorsKey, mutation.ActionName} {
+		for _, interceptor := range chain[chainKey] {
+			response, err := interceptor.interceptor.Intercept(mutation)
+			if err != nil {
+				common.GqlActionsInterceptedCounter.With(prometheus.Labels{"interceptor": interceptor.name, "result": "rejected"}).Inc()
+				return nil, err
+			}
+			if response != nil {
+				common.GqlActionsInterceptedCounter.With(prometheus.Labels{"interceptor": interceptor.name, "result": "responded"}).Inc()
+				return response, nil
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+func init() {
+	RegisterInterceptor("trace_log", newTraceLogInterceptor)
+	RegisterInterceptor("required_inputs", newRequiredInputsInterceptor)
+	RegisterInterceptor("session_variables_inputs", newSessionVariablesInputsInterceptor)
+	RegisterInterceptor("reject", newRejectInterceptor)
+	RegisterInterceptor("static_response", newStaticResponseInterceptor)
+}
+
+// newTraceLogInterceptor logs the input traceLog and appends the middleware timestamp to it (used by userSetConnectionAlive)
+func newTraceLogInterceptor(_ map[string]interface{}) (MutationInterceptor, error) {
+	return MutationInterceptorFunc(func(mutation *MutationContext) (*GqlActionsResponse, error) {
+		if traceLog, traceLogExists := mutation.Inputs["traceLog"]; traceLogExists && traceLog != "" {
+			meetingId := mutation.SessionVariables["x-hasura-meetingid"]
+			userId := mutation.SessionVariables["x-hasura-userid"]
+			mutation.Logger.Infof("Received %s meetingId=%s userId=%s", traceLog, meetingId, userId)
+
+			now := time.Now().UTC()
+			mutation.Inputs["traceLog"] = fmt.Sprintf("%s@gqlmiddleware|%s", traceLog, now.Format("2006-01-02T15:04:05.000Z"))
+		}
+		return nil, nil
+	}), nil
+}
+
+// newRequiredInputsInterceptor rejects the mutation when any input of option `inputs` (list) is missing
+func newRequiredInputsInterceptor(options map[string]interface{}) (MutationInterceptor, error) {
+	requiredInputs, err := getStringListOption(options, "inputs")
+	if err != nil {
+		return nil, err
+	}
+
+	return MutationInterceptorFunc(func(mutation *MutationContext) (*GqlActionsResponse, error) {
+		for _, inputName := range requiredInputs {
+			if value, exists := mutation.Inputs[inputName]; !exists || value == nil {
+				return nil, fmt.Errorf("Mutation %s is missing the required input %s", mutation.ActionName, inputName)
+			}
+		}
+		return nil, nil
+	}), nil
+}
+
+// newSessionVariablesInputsInterceptor sets inputs from the session variables, option `inputs` maps input name to session variable
+func newSessionVariablesInputsInterceptor(options map[string]interface{}) (MutationInterceptor, error) {
+	inputsOption, _ := options["inputs"].(map[string]interface{})
+	if len(inputsOption) == 0 {
+		return nil, fmt.Errorf("option inputs (map of input name to session variable) is required")
+	}
+
+	inputsSessionVariables := make(map[string]string, len(inputsOption))
+	for inputName, sessionVariable := range inputsOption {
+		sessionVariableAsString, isString := sessionVariable.(string)
+		if !isString {
+			return nil, fmt.Errorf("session variable of input %s must be a string", inputName)
+		}
+		inputsSessionVariables[inputName] = sessionVariableAsString
+	}
+
+	return MutationInterceptorFunc(func(mutation *MutationContext) (*GqlActionsResponse, error) {
+		for inputName, sessionVariable := range inputsSessionVariables {
+			if value, exists := mutation.SessionVariables[sessionVariable]; exists {
+				mutation.Inputs[inputName] = value
+			}
+		}
+		return nil, nil
+	}), nil
+}
+
+// newRejectInterceptor rejects all mutations with option `message` (e.g. to disable an action in a deployment)
+func newRejectInterceptor(options map[string]interface{}) (MutationInterceptor, error) {
+	message, _ := options["message"].(string)
+	if message == "" {
+		message = "Mutation not allowed"
+	}
+
+	return MutationInterceptorFunc(func(mutation *MutationContext) (*GqlActionsResponse, error) {
+		return nil, fmt.Errorf("%s", message)
+	}), nil
+}
+
+// newStaticResponseInterceptor answers all mutations with option `data` (`true` when not set) without sending them
+func newStaticResponseInterceptor(options map[string]interface{}) (MutationInterceptor, error) {
+	var data json.RawMessage
+	if dataOption, exists := options["data"]; exists {
+		dataAsJson, err := json.Marshal(dataOption)
+		if err != nil {
+			return nil, fmt.Errorf("invalid option data: %v", err)
+		}
+		data = dataAsJson
+	}
+
+	return MutationInterceptorFunc(func(mutation *MutationContext) (*GqlActionsResponse, error) {
+		return &GqlActionsResponse{Data: data}, nil
+	}), nil
+}
+
+func getStringListOption(options map[string]interface{}, optionName string) ([]string, error) {
+	optionValue, _ := options[optionName].([]interface{})
+	if len(optionValue) == 0 {
+		return nil, fmt.Errorf("option %s (list) is required", optionName)
+	}
+
+	values := make([]string, 0, len(optionValue))
+	for _, value := range optionValue {
+		valueAsString, isString := value.(string)
+		if !isString {
+			return nil, fmt.Errorf("option %s must contain only strings", optionName)
+		}
+		values = append(values, valueAsString)
+	}
+	return values, nil
+}
@@ -0,0 +1,88 @@
+package gql_actions
+
+import (
+	"bbb-graphql-middleware/config"
+	"bbb-graphql-middleware/internal/common"
+	"bbb-graphql-middleware/internal/ratelimit"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Priority lanes of the mutations, each one has its own channel, routine and rate limiter
+const (
+	LaneControl     = "control"
+	LaneInteractive = "interactive"
+	LaneBulk        = "bulk"
+)
+
+var PriorityLanes = []string{LaneControl, LaneInteractive, LaneBulk}
+
+var (
+	priorityLanesConfig = config.GetConfig().GraphqlActions.PriorityLanes
+	actionsLane         = getActionsLane()
+)
+
+func getActionsLane() map[string]string {
+	lanes := make(map[string]string)
+	for _, lane := range PriorityLanes {
+		for _, actionName := range priorityLanesConfig[lane].Actions {
+			lanes[actionName] = lane
+		}
+	}
+	return lanes
+}
+
+// GetMutationLane returns the lane of the action (config priority_lanes), actions not listed use the interactive lane
+func GetMutationLane(actionName string) string {
+	if lane, exists := actionsLane[actionName]; exists {
+		return lane
+	}
+	return LaneInteractive
+}
+
+// NewLaneChannels creates the channels of the priority lanes for a new browser connection
+func NewLaneChannels(defaultBufferSize int) map[string]*common.SafeChannelByte {
+	channels := make(map[string]*common.SafeChannelByte, len(PriorityLanes))
+	for _, lane := range PriorityLanes {
+		bufferSize := priorityLanesConfig[lane].BufferSize
+		if bufferSize <= 0 {
+			bufferSize = defaultBufferSize
+		}
+		channels[lane] = common.NewSafeChannelByte(bufferSize)
+	}
+	return channels
+}
+
+// EnqueueMutation sends the mutation received from the browser to the channel of the lane of its action
+// (root field of the parsed mutation). It never blocks the browser reader, when the lane is full the mutation
+// is rejected with a "busy" error.
+func EnqueueMutation(browserConnection *common.BrowserConnection, messageId string, actionName string, message []byte) {
+	lane := GetMutationLane(actionName)
+	laneChannel := browserConnection.FromBrowserToGqlActionsChannels[lane]
+
+	if !laneChannel.TrySend(message) && !laneChannel.Closed() {
+		common.GqlActionsLaneRejectedCounter.With(prometheus.Labels{"lane": lane}).Inc()
+		sendErrorMessage(browserConnection, messageId, "Too many pending mutations. Please try again later.")
+	}
+}
+
+// getLaneMutationPolicy returns the policy of the mutation, when the action has no policy (operation_policies)
+// the rate limit of its lane is used
+func getLaneMutationPolicy(browserConnection *common.BrowserConnection, lane string, actionName string, operationName string) ratelimit.OperationPolicy {
+	policy := ratelimit.GetMutationPolicy(browserConnection, actionName, operationName)
+	if policy.Name != ratelimit.DefaultPolicyName {
+		return policy
+	}
+
+	laneRatePerMinute := priorityLanesConfig[lane].MutationsPerMinute
+	if lane == LaneInteractive && laneRatePerMinute <= 0 {
+		// keep the connection limiter (max_connection_mutations_per_minute)
+		return policy
+	}
+
+	if laneRatePerMinute > 0 {
+		policy.RatePerMinute = laneRatePerMinute
+	}
+	policy.RateLimiter = ratelimit.GetConnectionRateLimiter(browserConnection, "mutations:"+lane, policy.RatePerMinute, policy.RatePerMinute)
+	return policy
+}
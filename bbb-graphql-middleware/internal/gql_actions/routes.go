@@ -0,0 +1,21 @@
+package gql_actions
+
+import (
+	"bbb-graphql-middleware/config"
+)
+
+// Upstreams that can execute a mutation (config graphql-actions.mutation_routes)
+const (
+	MutationUpstreamGraphqlActions = "graphql-actions"
+	MutationUpstreamHasura         = "hasura"
+)
+
+var mutationRoutes = config.GetConfig().GraphqlActions.MutationRoutes
+
+// GetMutationUpstream returns the upstream of the mutation root field, graphql-actions unless it's routed to Hasura
+func GetMutationUpstream(rootField string) string {
+	if mutationRoutes[rootField] == MutationUpstreamHasura {
+		return MutationUpstreamHasura
+	}
+	return MutationUpstreamGraphqlActions
+}
@@ -0,0 +1,72 @@
+package gql_actions
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"bbb-graphql-middleware/config"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	MutationTransportHttp         = "http"
+	MutationTransportRedisStreams = "redis_streams"
+)
+
+// MutationSink delivers the mutations to the backend that executes them (graphql-actions)
+type MutationSink interface {
+	Send(ctx context.Context, data GqlActionsRequestBody, idempotencyKey string, logger *log.Entry) (GqlActionsResponse, error)
+}
+
+var (
+	mutationSink     MutationSink
+	mutationSinkOnce sync.Once
+)
+
+// getMutationSink returns the sink of config graphql-actions.transport (http by default)
+func getMutationSink() MutationSink {
+	mutationSinkOnce.Do(func() {
+		switch transport := config.GetConfig().GraphqlActions.Transport; transport {
+		case MutationTransportRedisStreams:
+			mutationSink = newRedisStreamsMutationSink()
+		case "", MutationTransportHttp:
+			mutationSink = &httpMutationSink{}
+		default:
+			log.Errorf("Invalid graphql-actions.transport %s, using %s", transport, MutationTransportHttp)
+			mutationSink = &httpMutationSink{}
+		}
+	})
+
+	return mutationSink
+}
+
+// parseGqlActionsResult reads the result returned by graphql-actions (the same for any transport):
+// a status code other than 200 is an error, that can contain the message or the GraphQL-style errors to forward to the client
+func parseGqlActionsResult(statusCode int, status string, body []byte, logger *log.Entry) (GqlActionsResponse, error) {
+	if statusCode != 200 {
+		var result struct {
+			Message string          `json:"message"`
+			Errors  json.RawMessage `json:"errors"`
+		}
+		err := json.Unmarshal(body, &result)
+		if err == nil {
+			if result.Errors != nil {
+				logger.Errorf("graphql actions request failed: %s", string(result.Errors))
+				return GqlActionsResponse{}, &GqlActionsError{Message: status, StatusCode: statusCode, Errors: result.Errors}
+			}
+
+			if result.Message != "" {
+				logger.Errorf("graphql actions request failed: %s", result.Message)
+				return GqlActionsResponse{}, &GqlActionsError{Message: result.Message, StatusCode: statusCode}
+			}
+		}
+
+		return GqlActionsResponse{}, &GqlActionsError{Message: status, StatusCode: statusCode}
+	}
+
+	response := parseGqlActionsResponse(body)
+	response.StatusCode = statusCode
+	return response, nil
+}
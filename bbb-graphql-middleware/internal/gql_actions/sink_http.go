@@ -0,0 +1,118 @@
+package gql_actions
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"bbb-graphql-middleware/config"
+	"bbb-graphql-middleware/internal/common"
+	"bbb-graphql-middleware/internal/httpclient"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	graphqlActionsUrl             = config.GetConfig().GraphqlActions.Url
+	graphqlActionsMaxRetries      = config.GetConfig().GraphqlActions.MaxRetries
+	graphqlActionsRetryBackoff    = time.Duration(config.GetConfig().GraphqlActions.RetryBackoffMs) * time.Millisecond
+	graphqlActionsRetryMaxBackoff = time.Duration(config.GetConfig().GraphqlActions.RetryMaxBackoffMs) * time.Millisecond
+)
+
+// httpMutationSink posts the mutations to graphql-actions (config graphql-actions.url)
+type httpMutationSink struct{}
+
+func (s *httpMutationSink) Send(ctx context.Context, data GqlActionsRequestBody, idempotencyKey string, logger *log.Entry) (GqlActionsResponse, error) {
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return GqlActionsResponse{}, err
+	}
+
+	if graphqlActionsUrl == "" {
+		return GqlActionsResponse{}, fmt.Errorf("No Graphql Actions Url (BBB_GRAPHQL_MIDDLEWARE_GRAPHQL_ACTIONS_URL) set, aborting")
+	}
+
+	startedAt := time.Now()
+
+	// Retry on connection errors and 5xx responses, graphql-actions can dedupe them through the idempotency key
+	var response *http.Response
+	var body []byte
+	for attempt := 0; ; attempt++ {
+		response, body, err = postGqlActionsRequest(ctx, jsonData, idempotencyKey)
+
+		retryReason := ""
+		if err != nil {
+			if ctx.Err() != nil {
+				return GqlActionsResponse{}, err
+			}
+			retryReason = "connection_error"
+		} else if response.StatusCode >= 500 {
+			retryReason = "status_5xx"
+		}
+
+		if retryReason == "" || attempt >= graphqlActionsMaxRetries {
+			break
+		}
+
+		common.GqlActionsRetriesCounter.With(prometheus.Labels{"action": data.Action.Name, "reason": retryReason}).Inc()
+		retryBackoff := getRetryBackoff(attempt)
+		logger.Warnf("graphql actions request failed (%s), retrying in %v (attempt %d of %d)", retryReason, retryBackoff, attempt+1, graphqlActionsMaxRetries)
+
+		select {
+		case <-ctx.Done():
+			return GqlActionsResponse{}, ctx.Err()
+		case <-time.After(retryBackoff):
+		}
+	}
+	if err != nil {
+		return GqlActionsResponse{}, err
+	}
+
+	totalDurationMillis := time.Since(startedAt).Milliseconds()
+	logger = logger.WithField("duration", fmt.Sprintf("%v ms", totalDurationMillis)).WithField("statusCode", response.StatusCode)
+
+	logger.Tracef("Executed!")
+	if totalDurationMillis > 100 {
+		logger.Infof("Took too long to execute!")
+	}
+
+	return parseGqlActionsResult(response.StatusCode, response.Status, body, logger)
+}
+
+func postGqlActionsRequest(ctx context.Context, jsonData []byte, idempotencyKey string) (*http.Response, []byte, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, graphqlActionsUrl, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if idempotencyKey != "" {
+		request.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+
+	response, err := httpclient.Get(httpclient.GraphqlActions).Do(request)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return response, body, nil
+}
+
+// getRetryBackoff returns the exponential backoff of the attempt, limited by retry_max_backoff_ms
+func getRetryBackoff(attempt int) time.Duration {
+	retryBackoff := graphqlActionsRetryBackoff << attempt
+	if retryBackoff > graphqlActionsRetryMaxBackoff || retryBackoff <= 0 {
+		return graphqlActionsRetryMaxBackoff
+	}
+	return retryBackoff
+}
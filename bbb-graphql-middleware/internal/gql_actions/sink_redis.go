@@ -0,0 +1,182 @@
+package gql_actions
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"bbb-graphql-middleware/config"
+	"bbb-graphql-middleware/internal/common"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	log "github.com/sirupsen/logrus"
+)
+
+// redisStreamsReply is the result of a mutation, added by the consumer to the reply stream of the instance
+type redisStreamsReply struct {
+	statusCode int
+	body       []byte
+}
+
+// redisStreamsMutationSink adds the mutations to a Redis stream and waits for the reply (correlated by correlation_id)
+// in the reply stream of this instance, that is read by a single routine
+type redisStreamsMutationSink struct {
+	redisClient   *redis.Client
+	requestStream string
+	replyStream   string
+	maxLen        int64
+	timeout       time.Duration
+
+	pendingReplies      map[string]chan redisStreamsReply
+	pendingRepliesMutex sync.Mutex
+	replyReaderOnce     sync.Once
+}
+
+func newRedisStreamsMutationSink() *redisStreamsMutationSink {
+	redisStreamsConfig := config.GetConfig().GraphqlActions.RedisStreams
+
+	timeout := time.Duration(redisStreamsConfig.TimeoutMs) * time.Millisecond
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+
+	return &redisStreamsMutationSink{
+		redisClient:    common.NewRedisClient(),
+		requestStream:  redisStreamsConfig.RequestStream,
+		replyStream:    redisStreamsConfig.ReplyStreamPrefix + ":" + common.GetUniqueID(),
+		maxLen:         redisStreamsConfig.MaxLen,
+		timeout:        timeout,
+		pendingReplies: make(map[string]chan redisStreamsReply),
+	}
+}
+
+func (s *redisStreamsMutationSink) Send(ctx context.Context, data GqlActionsRequestBody, idempotencyKey string, logger *log.Entry) (GqlActionsResponse, error) {
+	s.replyReaderOnce.Do(func() {
+		go s.replyReaderRoutine()
+	})
+
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return GqlActionsResponse{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	correlationId := uuid.New().String()
+	replyChannel := make(chan redisStreamsReply, 1)
+	s.pendingRepliesMutex.Lock()
+	s.pendingReplies[correlationId] = replyChannel
+	s.pendingRepliesMutex.Unlock()
+
+	defer func() {
+		s.pendingRepliesMutex.Lock()
+		delete(s.pendingReplies, correlationId)
+		s.pendingRepliesMutex.Unlock()
+	}()
+
+	deadline, _ := ctx.Deadline()
+	startedAt := time.Now()
+
+	err = s.redisClient.XAdd(ctx, &redis.XAddArgs{
+		Stream: s.requestStream,
+		MaxLen: s.maxLen,
+		Approx: true,
+		Values: map[string]interface{}{
+			"correlation_id":  correlationId,
+			"reply_to":        s.replyStream,
+			"idempotency_key": idempotencyKey,
+			"deadline":        deadline.UnixMilli(),
+			"body":            jsonData,
+		},
+	}).Err()
+	if err != nil {
+		return GqlActionsResponse{}, fmt.Errorf("failed to add the request to the stream %s: %v", s.requestStream, err)
+	}
+
+	select {
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return GqlActionsResponse{}, fmt.Errorf("no reply received from graphql actions after %v", s.timeout)
+		}
+		return GqlActionsResponse{}, ctx.Err()
+	case reply := <-replyChannel:
+		totalDurationMillis := time.Since(startedAt).Milliseconds()
+		logger = logger.WithField("duration", fmt.Sprintf("%v ms", totalDurationMillis)).WithField("statusCode", reply.statusCode)
+
+		logger.Tracef("Executed!")
+		if totalDurationMillis > 100 {
+			logger.Infof("Took too long to execute!")
+		}
+
+		return parseGqlActionsResult(reply.statusCode, fmt.Sprintf("%d %s", reply.statusCode, http.StatusText(reply.statusCode)), reply.body, logger)
+	}
+}
+
+// replyReaderRoutine reads the reply stream of this instance and delivers each reply to the request waiting for it
+func (s *redisStreamsMutationSink) replyReaderRoutine() {
+	logger := log.WithField("_routine", "RedisStreamsReplyReader").WithField("stream", s.replyStream)
+
+	// The reply stream is exclusive of this instance (it contains the unique id), so it's read from the beginning
+	lastId := "0-0"
+	for {
+		streams, err := s.redisClient.XRead(context.Background(), &redis.XReadArgs{
+			Streams: []string{s.replyStream, lastId},
+			Count:   100,
+			Block:   5 * time.Second,
+		}).Result()
+		if err != nil {
+			if !errors.Is(err, redis.Nil) {
+				logger.Errorf("error while reading replies: %v", err)
+				time.Sleep(1 * time.Second)
+			}
+			continue
+		}
+
+		processedIds := make([]string, 0)
+		for _, stream := range streams {
+			for _, message := range stream.Messages {
+				lastId = message.ID
+				processedIds = append(processedIds, message.ID)
+				s.deliverReply(message.Values, logger)
+			}
+		}
+
+		if len(processedIds) > 0 {
+			if err := s.redisClient.XDel(context.Background(), s.replyStream, processedIds...).Err(); err != nil {
+				logger.Warnf("failed to remove processed replies: %v", err)
+			}
+		}
+	}
+}
+
+func (s *redisStreamsMutationSink) deliverReply(values map[string]interface{}, logger *log.Entry) {
+	correlationId, _ := values["correlation_id"].(string)
+	statusAsString, _ := values["status"].(string)
+	body, _ := values["body"].(string)
+
+	statusCode, err := strconv.Atoi(statusAsString)
+	if err != nil {
+		statusCode = 200
+	}
+
+	s.pendingRepliesMutex.Lock()
+	replyChannel, exists := s.pendingReplies[correlationId]
+	s.pendingRepliesMutex.Unlock()
+
+	if !exists {
+		logger.Debugf("reply %s received after the timeout (or for an unknown request), discarding", correlationId)
+		return
+	}
+
+	select {
+	case replyChannel <- redisStreamsReply{statusCode: statusCode, body: []byte(body)}:
+	default:
+	}
+}
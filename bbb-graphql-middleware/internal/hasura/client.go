@@ -17,6 +17,7 @@ import (
 	"github.com/coder/websocket"
 
 	"bbb-graphql-middleware/internal/common"
+	"bbb-graphql-middleware/internal/wscompression"
 
 	"golang.org/x/xerrors"
 )
@@ -24,6 +25,8 @@ import (
 var (
 	lastHasuraConnectionId uint64
 	hasuraEndpoint         = config.GetConfig().Hasura.Url
+	// Shared by the connections to Hasura (counting the bytes sent through the network)
+	hasuraTransport = wscompression.NewCountingTransport(common.NewWireBytesCounter(common.WsConnectionHasura))
 )
 
 // Hasura client connection
@@ -54,10 +57,14 @@ func HasuraClient(
 	parsedURL.Scheme = "http"
 	jar.SetCookies(parsedURL, browserConnection.BrowserRequestCookies)
 	hc := &http.Client{
-		Jar: jar,
+		Jar:       jar,
+		Transport: hasuraTransport,
 	}
 	dialOptions.HTTPClient = hc
 
+	// Add compression (used only when Hasura supports it)
+	wscompression.SetDialOptions(&dialOptions)
+
 	// Create a context for the hasura connection, that depends on the browser context
 	// this means that if browser connection is closed, the hasura connection will close also
 	// this also means that we can close the hasura connection without closing the browser one
@@ -89,10 +96,11 @@ func HasuraClient(
 	}()
 
 	// Make the connection
-	hasuraWsConn, _, err := websocket.Dial(hasuraConnectionContext, hasuraEndpoint, &dialOptions)
+	hasuraWsConn, hasuraResponse, err := websocket.Dial(hasuraConnectionContext, hasuraEndpoint, &dialOptions)
 	if err != nil {
 		return xerrors.Errorf("error connecting to hasura: %v", err)
 	}
+	wscompression.RecordNegotiation(common.WsConnectionHasura, config.GetConfig().Hasura.Compression.Mode, hasuraResponse.Header)
 	defer hasuraWsConn.Close(websocket.StatusInternalError, "the sky is falling")
 
 	hasuraWsConn.SetReadLimit(math.MaxInt64 - 1)
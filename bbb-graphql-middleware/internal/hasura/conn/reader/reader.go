@@ -6,7 +6,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"hash/crc32"
+	"reflect"
 	"strings"
 	"sync"
 	"time"
@@ -62,6 +62,7 @@ func HasuraConnectionReader(hc *common.HasuraConnection, wg *sync.WaitGroup) {
 		}
 
 		hc.BrowserConn.Logger.Tracef("received from hasura: %s", string(message))
+		common.AddRawBytes(common.WsConnectionHasura, "received", len(message))
 
 		handleMessageReceivedFromHasura(hc, message)
 	}
@@ -111,6 +112,9 @@ func handleMessageReceivedFromHasura(hc *common.HasuraConnection, message []byte
 		if hasuraMessageInfo.Type == "next" &&
 			subscription.Type == common.Subscription {
 
+			// Hold the resyncs while the last data is updated and the patch is created from the previous one
+			hc.BrowserConn.SubscriptionsDataMutex.Lock()
+
 			// Remove queryId from message
 			message = bytes.Replace(message, queryIdInBytes, QueryIdPlaceholderInBytes, 1)
 			queryIdReplacementApplied = true
@@ -119,9 +123,16 @@ func handleMessageReceivedFromHasura(hc *common.HasuraConnection, message []byte
 
 			// Stop processing case it is the same message (probably is a reconnection with Hasura)
 			if !isDifferentFromPreviousMessage {
+				hc.BrowserConn.SubscriptionsDataMutex.Unlock()
 				return
 			}
 
+			// Take the send turn before releasing the data, so a resync can't be sent before this patch
+			// (without holding the data while waiting for the browser channel)
+			hc.BrowserConn.SubscriptionsSendMutex.Lock()
+			defer hc.BrowserConn.SubscriptionsSendMutex.Unlock()
+			hc.BrowserConn.SubscriptionsDataMutex.Unlock()
+
 			// Inject pg + gql-middleware time to traceLog
 			if subscription.OperationName == "ConnStatusWithTraceLog" {
 				_, _, messageData := getHasuraMessage(message, subscription, hc.BrowserConn.Logger)
@@ -189,7 +200,11 @@ func handleSubscriptionMessage(hc *common.HasuraConnection, message *[]byte, sub
 
 	lastDataChecksumWas := subscription.LastReceivedDataChecksum
 	lastReceivedDataWas := subscription.LastReceivedData
-	cacheKey := mergeUint32(subscription.LastReceivedDataChecksum, dataChecksum)
+	cacheKey := common.PatchCacheKey{
+		LastDataChecksum: subscription.LastReceivedDataChecksum,
+		CurrDataChecksum: dataChecksum,
+		DiffFormat:       subscription.DiffFormat,
+	}
 
 	// Store LastReceivedData Checksum
 	subscription.LastReceivedData = messageData
@@ -200,20 +215,16 @@ func handleSubscriptionMessage(hc *common.HasuraConnection, message *[]byte, sub
 
 	// Apply msg patch when it supports it
 	if subscription.JsonPatchSupported {
-		*message = msgpatch.GetPatchedMessage(*message, messageDataKey, lastReceivedDataWas, messageData, cacheKey, lastDataChecksumWas, dataChecksum)
+		*message = msgpatch.GetPatchedMessage(*message, subscription.OperationName, messageDataKey, lastReceivedDataWas, messageData, cacheKey, lastDataChecksumWas, dataChecksum)
 	}
 
 	return true
 }
 
-func mergeUint32(a, b uint32) uint32 {
-	return (a << 16) | (b >> 16)
-}
-
 func handleStreamingMessage(hc *common.HasuraConnection, message []byte, subscription common.GraphQlSubscription, queryId string) {
-	lastCursor := common.GetLastStreamCursorValueFromReceivedMessage(message, subscription.StreamCursorField)
-	if lastCursor != nil && subscription.StreamCursorCurrValue != lastCursor {
-		subscription.StreamCursorCurrValue = lastCursor
+	lastCursorValues := common.GetLastStreamCursorValuesFromReceivedMessage(message, subscription.StreamCursorFields)
+	if lastCursorValues != nil && !reflect.DeepEqual(subscription.StreamCursorCurrValues, lastCursorValues) {
+		subscription.StreamCursorCurrValues = lastCursorValues
 
 		hc.BrowserConn.ActiveSubscriptionsMutex.Lock()
 		hc.BrowserConn.ActiveSubscriptions[queryId] = subscription
@@ -244,29 +255,29 @@ func handleConnectionAckMessage(hc *common.HasuraConnection, message []byte) {
 	go retransmiter.RetransmitSubscriptionStartMessages(hc)
 }
 
-func getHasuraMessage(message []byte, subscription common.GraphQlSubscription, logger *logrus.Entry) (uint32, string, common.HasuraMessage) {
-	dataChecksum := crc32.ChecksumIEEE(message)
+func getHasuraMessage(message []byte, subscription common.GraphQlSubscription, logger *logrus.Entry) (uint64, string, common.HasuraMessage) {
+	dataChecksum := common.GetDataChecksum(message)
 
-	common.GlobalCacheLocks.Lock(dataChecksum)
-	defer common.GlobalCacheLocks.Unlock(dataChecksum)
+	cachedHasuraMessage := common.HasuraMessageCache.GetOrLoad(dataChecksum, len(message), func() (common.HasuraMessageCacheEntry, int) {
+		return parseHasuraMessage(message, subscription, logger), len(message)
+	})
 
-	dataKey, hasuraMessage, dataMapExists := common.GetHasuraMessageCache(dataChecksum)
-	if dataMapExists {
-		return dataChecksum, dataKey, hasuraMessage
-	}
+	return dataChecksum, cachedHasuraMessage.DataKey, cachedHasuraMessage.HasuraMessage
+}
 
+func parseHasuraMessage(message []byte, subscription common.GraphQlSubscription, logger *logrus.Entry) common.HasuraMessageCacheEntry {
+	var hasuraMessage common.HasuraMessage
 	err := json.Unmarshal(message, &hasuraMessage)
 	if err != nil {
 		logger.Fatalf("Error unmarshalling JSON: %v", err)
 	}
 
+	var dataKey string
 	for key := range hasuraMessage.Payload.Data {
 		dataKey = key
 		break
 	}
 
-	common.StoreHasuraMessageCache(dataChecksum, dataKey, hasuraMessage)
-
 	// Add Prometheus metrics only once for each dataChecksum
 	dataSize := len(string(message))
 	common.GqlReceivedDataPayloadSize.
@@ -294,7 +305,10 @@ func getHasuraMessage(message []byte, subscription common.GraphQlSubscription, l
 		}
 	}
 
-	return dataChecksum, dataKey, hasuraMessage
+	return common.HasuraMessageCacheEntry{
+		DataKey:       dataKey,
+		HasuraMessage: hasuraMessage,
+	}
 }
 
 func includePromotheusMetrics(traceLog string, meetingId string, logger *logrus.Entry) {
@@ -12,11 +12,10 @@ import (
 
 	"bbb-graphql-middleware/config"
 	"bbb-graphql-middleware/internal/common"
+	"bbb-graphql-middleware/internal/msgpatch"
+	"bbb-graphql-middleware/internal/ratelimit"
 
 	"github.com/coder/websocket"
-	"github.com/graphql-go/graphql/language/ast"
-	"github.com/graphql-go/graphql/language/parser"
-	"github.com/graphql-go/graphql/language/source"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -70,10 +69,12 @@ RangeLoop:
 					continue
 				}
 
+				// Mutations routed to Hasura (graphql-actions.mutation_routes) were already limited by GraphqlActionsClient
+				fromBrowserMessage, forwardedMutation := common.UnmarkForwardedMutation(fromBrowserMessage)
+
 				// var fromBrowserMessageAsMap = fromBrowserMessage.(map[string]interface{})
 
-				var browserMessage common.BrowserSubscribeMessage
-				err := json.Unmarshal(fromBrowserMessage, &browserMessage)
+				browserMessage, err := common.UnmarshalBrowserSubscribeMessage(fromBrowserMessage)
 				if err != nil {
 					hc.BrowserConn.Logger.Errorf("failed to unmarshal message: %v", err)
 					return
@@ -82,13 +83,26 @@ RangeLoop:
 				if browserMessage.Type == "subscribe" {
 					queryId := browserMessage.ID
 
+					// Limits from config operation_policies (or the connection limits when the operation has no policy)
+					policy := ratelimit.GetQueryPolicy(browserConnection, browserMessage.Payload.OperationName)
+
+					if forwardedMutation {
+						policy = ratelimit.OperationPolicy{Name: policy.Name}
+					}
+
 					// Rate limiter from config max_connection_queries_per_minute
-					ctxRateLimiter, _ := context.WithTimeout(hc.Context, 30*time.Second)
-					if err := hc.BrowserConn.FromBrowserToHasuraRateLimiter.Wait(ctxRateLimiter); err != nil {
+					var errRateLimiter error
+					if policy.RateLimiter != nil {
+						ctxRateLimiter, cancelCtxRateLimiter := context.WithTimeout(hc.Context, 30*time.Second)
+						errRateLimiter = policy.RateLimiter.Wait(ctxRateLimiter)
+						cancelCtxRateLimiter()
+					}
+					if errRateLimiter != nil {
+						policy.Reject("rate_limit")
 						sendErrorMessage(
 							browserConnection,
 							queryId,
-							fmt.Sprintf("Rate limit exceeded: Maximum %d queries per minute allowed. Please try again later.", config.GetConfig().Server.MaxConnectionQueriesPerMinute),
+							fmt.Sprintf("Rate limit exceeded: Maximum %d queries per minute allowed. Please try again later.", policy.RatePerMinute),
 						)
 
 						continue
@@ -96,31 +110,32 @@ RangeLoop:
 
 					// Identify type based on query string
 					messageType := common.Query
-					var lastReceivedDataChecksum uint32
-					streamCursorField := ""
-					streamCursorVariableName := ""
-					var streamCursorInitialValue interface{}
+					var lastReceivedDataChecksum uint64
+					var streamCursorFields []common.StreamCursorField
+					var streamCursorValues map[string]interface{}
 
 					query := browserMessage.Payload.Query
 
-					if config.GetConfig().Server.MaxQueryDepth > 0 {
-						queryDepth, _ := calculateQueryDepth(query)
-						if queryDepth > config.GetConfig().Server.MaxQueryDepth {
+					if policy.MaxDepth > 0 {
+						queryDepth, _ := common.CalculateQueryDepth(query)
+						if queryDepth > policy.MaxDepth {
+							policy.Reject("max_depth")
 							sendErrorMessage(
 								browserConnection,
 								queryId,
-								fmt.Sprintf("Query %s is not valid with depth %d and the max allowed is %d", browserMessage.Payload.OperationName, queryDepth, config.GetConfig().Server.MaxQueryDepth))
+								fmt.Sprintf("Query %s is not valid with depth %d and the max allowed is %d", browserMessage.Payload.OperationName, queryDepth, policy.MaxDepth))
 							continue
 						}
 					}
 
-					if config.GetConfig().Server.MaxQueryLength > 0 {
+					if policy.MaxLength > 0 {
 						queryLength := len(query)
-						if queryLength > config.GetConfig().Server.MaxQueryLength {
+						if queryLength > policy.MaxLength {
+							policy.Reject("max_length")
 							sendErrorMessage(
 								browserConnection,
 								queryId,
-								fmt.Sprintf("Query %s is not valid with length %d and the max allowed is %d", browserMessage.Payload.OperationName, queryLength, config.GetConfig().Server.MaxQueryLength))
+								fmt.Sprintf("Query %s is not valid with length %d and the max allowed is %d", browserMessage.Payload.OperationName, queryLength, policy.MaxLength))
 							continue
 						}
 					}
@@ -170,19 +185,18 @@ RangeLoop:
 							browserConnection.ActiveSubscriptionsMutex.RUnlock()
 							if queryIdExists {
 								lastReceivedDataChecksum = existingSubscriptionData.LastReceivedDataChecksum
-								streamCursorField = existingSubscriptionData.StreamCursorField
-								streamCursorVariableName = existingSubscriptionData.StreamCursorVariableName
-								streamCursorInitialValue = existingSubscriptionData.StreamCursorCurrValue
+								streamCursorFields = existingSubscriptionData.StreamCursorFields
+								streamCursorValues = existingSubscriptionData.StreamCursorCurrValues
 							}
 
-							if strings.Contains(query, "_stream(") && strings.Contains(query, "cursor: {") {
+							if strings.Contains(query, "_stream(") && strings.Contains(query, "cursor:") {
 								messageType = common.Streaming
 								if !queryIdExists {
-									streamCursorField, streamCursorVariableName, streamCursorInitialValue = common.GetStreamCursorPropsFromBrowserMessage(browserMessage)
+									streamCursorFields, streamCursorValues = common.GetStreamCursorPropsFromBrowserMessage(browserMessage)
 
-									// It's necessary to assure the cursor field will return in the result of the query
-									// To be able to store the last received cursor value
-									browserMessage.Payload.Query = common.PatchQueryIncludingCursorField(query, streamCursorField)
+									// It's necessary to assure the cursor fields will return in the result of the query
+									// To be able to store the last received cursor values
+									browserMessage.Payload.Query = common.PatchQueryIncludingCursorFields(query, streamCursorFields)
 
 									newMessageJson, _ := json.Marshal(browserMessage)
 									fromBrowserMessage = newMessageJson
@@ -194,16 +208,18 @@ RangeLoop:
 							}
 						}
 
-						if strings.HasPrefix(query, "mutation") {
+						if forwardedMutation || strings.HasPrefix(query, "mutation") {
 							messageType = common.Mutation
 						}
 					}
 
-					// Identify if the client that requested this subscription expects to receive json-patch
-					// Client append `Patched_` to the query operationName to indicate that it supports
+					// Identify if the client that requested this subscription expects to receive patches (and their format)
+					// Client append `Patched_` to the query operationName or set extensions.diffFormat to indicate that it supports
 					jsonPatchSupported := false
-					if !jsonPatchDisabled && strings.HasPrefix(browserMessage.Payload.OperationName, "Patched_") {
-						jsonPatchSupported = true
+					var diffFormat common.DiffFormat
+					if !jsonPatchDisabled {
+						diffFormat = msgpatch.GetDiffFormat(browserMessage)
+						jsonPatchSupported = diffFormat != ""
 					}
 
 					browserConnection.ActiveSubscriptionsMutex.Lock()
@@ -211,11 +227,11 @@ RangeLoop:
 						Id:                         queryId,
 						Message:                    fromBrowserMessage,
 						OperationName:              browserMessage.Payload.OperationName,
-						StreamCursorField:          streamCursorField,
-						StreamCursorVariableName:   streamCursorVariableName,
-						StreamCursorCurrValue:      streamCursorInitialValue,
+						StreamCursorFields:         streamCursorFields,
+						StreamCursorCurrValues:     streamCursorValues,
 						LastSeenOnHasuraConnection: hc.Id,
 						JsonPatchSupported:         jsonPatchSupported,
+						DiffFormat:                 diffFormat,
 						Type:                       messageType,
 						LastReceivedDataChecksum:   lastReceivedDataChecksum,
 					}
@@ -277,6 +293,7 @@ RangeLoop:
 						}
 						return
 					}
+					common.AddRawBytes(common.WsConnectionHasura, "sent", len(fromBrowserMessage))
 				}
 			}
 		}
@@ -304,58 +321,6 @@ RangeLoop:
 //	}
 //}
 
-func calculateQueryDepth(query string) (int, error) {
-	src := source.NewSource(&source.Source{
-		Body: []byte(query),
-		Name: "GraphQL query",
-	})
-	astDoc, err := parser.Parse(parser.ParseParams{
-		Source: src,
-	})
-	if err != nil {
-		return 0, fmt.Errorf("failed to parse query: %v", err)
-	}
-
-	maxDepth := 0
-	for _, def := range astDoc.Definitions {
-		if op, ok := def.(*ast.OperationDefinition); ok {
-			depth := traverseSelectionSet(op.SelectionSet, 0)
-			if depth > maxDepth {
-				maxDepth = depth
-			}
-		}
-	}
-
-	return maxDepth, nil
-}
-
-func traverseSelectionSet(selectionSet *ast.SelectionSet, currentDepth int) int {
-	if selectionSet == nil {
-		return currentDepth
-	}
-
-	currentDepth++
-	maxDepth := currentDepth
-
-	for _, selection := range selectionSet.Selections {
-		var depth int
-		switch sel := selection.(type) {
-		case *ast.Field:
-			depth = traverseSelectionSet(sel.SelectionSet, currentDepth)
-		case *ast.InlineFragment:
-			depth = traverseSelectionSet(sel.SelectionSet, currentDepth)
-		case *ast.FragmentSpread:
-			// Without a schema, we cannot resolve fragment spreads
-			continue
-		}
-		if depth > maxDepth {
-			maxDepth = depth
-		}
-	}
-
-	return maxDepth
-}
-
 func sendErrorMessage(browserConnection *common.BrowserConnection, messageId string, errorMessage string) {
 	browserConnection.Logger.Errorf(errorMessage)
 
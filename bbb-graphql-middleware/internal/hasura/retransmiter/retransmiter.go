@@ -31,7 +31,7 @@ func RetransmitSubscriptionStartMessages(hc *common.HasuraConnection) {
 		if subscription.LastSeenOnHasuraConnection != hc.Id {
 			hc.BrowserConn.Logger.Tracef("retransmiting subscription start: %v", string(subscription.Message))
 
-			if subscription.Type == common.Streaming && subscription.StreamCursorCurrValue != nil {
+			if subscription.Type == common.Streaming && len(subscription.StreamCursorCurrValues) > 0 {
 				hc.BrowserConn.FromBrowserToHasuraChannel.SendWait(hc.Context, common.PatchQuerySettingLastCursorValue(subscription))
 			} else {
 				hc.BrowserConn.FromBrowserToHasuraChannel.SendWait(hc.Context, subscription.Message)
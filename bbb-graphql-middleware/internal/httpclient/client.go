@@ -0,0 +1,195 @@
+package httpclient
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"bbb-graphql-middleware/config"
+	"bbb-graphql-middleware/internal/common"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// Upstreams that can have their own settings in http_client.upstreams
+const (
+	GraphqlActions  = "graphql_actions"
+	AuthHook        = "auth_hook"
+	SessionVarsHook = "session_vars_hook"
+)
+
+var (
+	clients      = make(map[string]*http.Client)
+	clientsMutex sync.Mutex
+)
+
+// Get returns the shared client of the upstream (created on the first call).
+// The clients don't have a cookie jar, as they are shared by all users.
+func Get(upstream string) *http.Client {
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+
+	if client, exists := clients[upstream]; exists {
+		return client
+	}
+
+	client := newClient(upstream, getUpstreamConfig(upstream))
+	clients[upstream] = client
+	return client
+}
+
+// getUpstreamConfig applies the settings set in http_client.upstreams.<upstream> to the default ones
+// (including zero values, e.g. an empty proxy_url or max_conns_per_host 0)
+func getUpstreamConfig(upstream string) config.HttpClientConfig {
+	httpClientConfig := config.GetConfig().HttpClient.HttpClientConfig
+	upstreamConfig, exists := config.GetConfig().HttpClient.Upstreams[upstream]
+	if !exists {
+		return httpClientConfig
+	}
+
+	override(&httpClientConfig.TimeoutMs, upstreamConfig.TimeoutMs)
+	override(&httpClientConfig.ConnectTimeoutMs, upstreamConfig.ConnectTimeoutMs)
+	override(&httpClientConfig.ResponseHeaderTimeoutMs, upstreamConfig.ResponseHeaderTimeoutMs)
+	override(&httpClientConfig.IdleConnTimeoutSeconds, upstreamConfig.IdleConnTimeoutSeconds)
+	override(&httpClientConfig.MaxIdleConns, upstreamConfig.MaxIdleConns)
+	override(&httpClientConfig.MaxIdleConnsPerHost, upstreamConfig.MaxIdleConnsPerHost)
+	override(&httpClientConfig.MaxConnsPerHost, upstreamConfig.MaxConnsPerHost)
+	override(&httpClientConfig.ProxyUrl, upstreamConfig.ProxyUrl)
+	override(&httpClientConfig.UnixSocket, upstreamConfig.UnixSocket)
+	override(&httpClientConfig.TlsCaFile, upstreamConfig.TlsCaFile)
+	override(&httpClientConfig.TlsCertFile, upstreamConfig.TlsCertFile)
+	override(&httpClientConfig.TlsKeyFile, upstreamConfig.TlsKeyFile)
+	override(&httpClientConfig.TlsInsecureSkipVerify, upstreamConfig.TlsInsecureSkipVerify)
+	return httpClientConfig
+}
+
+func override[T any](setting *T, upstreamSetting *T) {
+	if upstreamSetting != nil {
+		*setting = *upstreamSetting
+	}
+}
+
+func newClient(upstream string, httpClientConfig config.HttpClientConfig) *http.Client {
+	logger := log.WithField("_routine", "HttpClient").WithField("upstream", upstream)
+
+	dialer := &net.Dialer{
+		Timeout:   time.Duration(httpClientConfig.ConnectTimeoutMs) * time.Millisecond,
+		KeepAlive: 30 * time.Second,
+	}
+
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          httpClientConfig.MaxIdleConns,
+		MaxIdleConnsPerHost:   httpClientConfig.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       httpClientConfig.MaxConnsPerHost,
+		IdleConnTimeout:       time.Duration(httpClientConfig.IdleConnTimeoutSeconds) * time.Second,
+		ResponseHeaderTimeout: time.Duration(httpClientConfig.ResponseHeaderTimeoutMs) * time.Millisecond,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	switch httpClientConfig.ProxyUrl {
+	case "":
+	case "direct":
+		transport.Proxy = nil
+	default:
+		if proxyUrl, err := url.Parse(httpClientConfig.ProxyUrl); err == nil {
+			transport.Proxy = http.ProxyURL(proxyUrl)
+		} else {
+			logger.Errorf("Invalid proxy_url %s: %v", httpClientConfig.ProxyUrl, err)
+		}
+	}
+
+	if httpClientConfig.UnixSocket != "" {
+		socketPath := httpClientConfig.UnixSocket
+		transport.Proxy = nil
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socketPath)
+		}
+	}
+
+	if tlsConfig, err := newTlsConfig(httpClientConfig); err == nil {
+		transport.TLSClientConfig = tlsConfig
+	} else {
+		logger.Errorf("Error while loading the TLS settings, using the default ones: %v", err)
+	}
+
+	return &http.Client{
+		Transport: &instrumentedTransport{upstream: upstream, transport: transport},
+		Timeout:   time.Duration(httpClientConfig.TimeoutMs) * time.Millisecond,
+	}
+}
+
+func newTlsConfig(httpClientConfig config.HttpClientConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: httpClientConfig.TlsInsecureSkipVerify, //nolint:gosec // explicitly enabled in config
+	}
+
+	if httpClientConfig.TlsCaFile != "" {
+		caCert, err := os.ReadFile(filepath.Clean(httpClientConfig.TlsCaFile))
+		if err != nil {
+			return nil, err
+		}
+		caCertPool := x509.NewCertPool()
+		if !caCertPool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no certificate found in %s", httpClientConfig.TlsCaFile)
+		}
+		tlsConfig.RootCAs = caCertPool
+	}
+
+	if httpClientConfig.TlsCertFile != "" || httpClientConfig.TlsKeyFile != "" {
+		clientCert, err := tls.LoadX509KeyPair(filepath.Clean(httpClientConfig.TlsCertFile), filepath.Clean(httpClientConfig.TlsKeyFile))
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{clientCert}
+	}
+
+	return tlsConfig, nil
+}
+
+// instrumentedTransport records the latency and the errors of the requests of an upstream
+type instrumentedTransport struct {
+	upstream  string
+	transport http.RoundTripper
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	startedAt := time.Now()
+	resp, err := t.transport.RoundTrip(req)
+	common.HttpClientRequestDuration.With(prometheus.Labels{"upstream": t.upstream}).Observe(float64(time.Since(startedAt).Milliseconds()))
+
+	if err != nil {
+		common.HttpClientErrorsCounter.With(prometheus.Labels{"upstream": t.upstream, "reason": getErrorReason(err)}).Inc()
+	} else if resp.StatusCode >= 500 {
+		common.HttpClientErrorsCounter.With(prometheus.Labels{"upstream": t.upstream, "reason": "status_5xx"}).Inc()
+	}
+
+	return resp, err
+}
+
+func getErrorReason(err error) string {
+	if errors.Is(err, context.Canceled) {
+		return "canceled"
+	}
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return "timeout"
+	}
+
+	return "connection_error"
+}
@@ -0,0 +1,346 @@
+package jwtauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"bbb-graphql-middleware/config"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var jwtConfig = config.GetConfig().AuthJwt
+
+var (
+	verificationKeys     []verificationKey
+	verificationKeysOnce sync.Once
+)
+
+// Authorization contains the info obtained from a valid token
+type Authorization struct {
+	MeetingId        string
+	UserId           string
+	SessionToken     string            // claim `sessionToken`, empty only when session_token_claim_optional is enabled
+	SessionVariables map[string]string // x-hasura-* claims
+}
+
+func Enabled() bool {
+	return jwtConfig.Enabled
+}
+
+func FallbackToHooks() bool {
+	return jwtConfig.FallbackToHooks
+}
+
+func getVerificationKeys() []verificationKey {
+	verificationKeysOnce.Do(func() {
+		logger := log.WithField("_routine", "JwtAuth")
+
+		if jwtConfig.HmacSecret != "" {
+			verificationKeys = append(verificationKeys, verificationKey{key: []byte(jwtConfig.HmacSecret)})
+		}
+
+		if jwtConfig.PublicKeyFile != "" {
+			if keys, err := loadPublicKeysFromPemFile(jwtConfig.PublicKeyFile); err == nil {
+				verificationKeys = append(verificationKeys, keys...)
+			} else {
+				logger.Errorf("Error while loading auth_jwt.public_key_file (%s): %v", jwtConfig.PublicKeyFile, err)
+			}
+		}
+
+		if jwtConfig.JwksFile != "" {
+			if keys, err := loadKeysFromJwksFile(jwtConfig.JwksFile); err == nil {
+				verificationKeys = append(verificationKeys, keys...)
+			} else {
+				logger.Errorf("Error while loading auth_jwt.jwks_file (%s): %v", jwtConfig.JwksFile, err)
+			}
+		}
+
+		if len(verificationKeys) == 0 {
+			logger.Error("auth_jwt is enabled but no key was configured")
+		}
+	})
+
+	return verificationKeys
+}
+
+// GetTokenFromHeaders returns the token sent in the `connection_init` headers (header name is case-insensitive)
+func GetTokenFromHeaders(headers map[string]interface{}) (string, bool) {
+	headerName := jwtConfig.Header
+	if headerName == "" {
+		headerName = "Authorization"
+	}
+
+	for key, value := range headers {
+		if !strings.EqualFold(key, headerName) {
+			continue
+		}
+
+		token, isString := value.(string)
+		if !isString {
+			return "", false
+		}
+
+		token = strings.TrimSpace(token)
+		if len(token) > 7 && strings.EqualFold(token[:7], "Bearer ") {
+			token = strings.TrimSpace(token[7:])
+		}
+		return token, token != ""
+	}
+
+	return "", false
+}
+
+// VerifyToken validates signature, expiration, issuer and audience of the token, and that it was issued
+// for the sessionToken, and returns the info of its claims
+func VerifyToken(token string, sessionToken string) (Authorization, error) {
+	claims, err := verifyAndDecodeToken(token)
+	if err != nil {
+		return Authorization{}, err
+	}
+
+	authorization, err := getAuthorizationFromClaims(claims)
+	if err != nil {
+		return authorization, err
+	}
+
+	if authorization.SessionToken == "" && !jwtConfig.SessionTokenClaimOptional {
+		return authorization, fmt.Errorf("sessionToken missing in token claims")
+	}
+	if authorization.SessionToken != "" && authorization.SessionToken != sessionToken {
+		return authorization, fmt.Errorf("token was not issued for this sessionToken")
+	}
+
+	return authorization, nil
+}
+
+func verifyAndDecodeToken(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed token header: %v", err)
+	}
+
+	if header.Alg == "" || strings.EqualFold(header.Alg, "none") {
+		return nil, fmt.Errorf("unsigned tokens are not allowed")
+	}
+
+	if len(jwtConfig.Algorithms) > 0 && !slices.Contains(jwtConfig.Algorithms, header.Alg) {
+		return nil, fmt.Errorf("algorithm %s not allowed", header.Alg)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature: %v", err)
+	}
+
+	signingInput := []byte(parts[0] + "." + parts[1])
+	signatureVerified := false
+	for _, key := range getVerificationKeys() {
+		if header.Kid != "" && key.kid != "" && key.kid != header.Kid {
+			continue
+		}
+
+		if verifySignature(header.Alg, key.key, signingInput, signature) {
+			signatureVerified = true
+			break
+		}
+	}
+
+	if !signatureVerified {
+		return nil, fmt.Errorf("invalid token signature")
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed token claims: %v", err)
+	}
+
+	if err := validateRegisteredClaims(claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+func decodeSegment(segment string, target interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(segment, "="))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, target)
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signingInput []byte, signature []byte) bool {
+	if len(alg) != 5 {
+		return false
+	}
+
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return false
+	}
+
+	switch alg[:2] {
+	case "HS":
+		secret, isSecret := key.([]byte)
+		if !isSecret {
+			return false
+		}
+		mac := hmac.New(hash.New, secret)
+		mac.Write(signingInput)
+		return hmac.Equal(mac.Sum(nil), signature)
+	case "RS", "PS":
+		publicKey, isRsa := key.(*rsa.PublicKey)
+		if !isRsa {
+			return false
+		}
+		hasher := hash.New()
+		hasher.Write(signingInput)
+		if alg[:2] == "PS" {
+			return rsa.VerifyPSS(publicKey, hash, hasher.Sum(nil), signature, nil) == nil
+		}
+		return rsa.VerifyPKCS1v15(publicKey, hash, hasher.Sum(nil), signature) == nil
+	case "ES":
+		publicKey, isEcdsa := key.(*ecdsa.PublicKey)
+		if !isEcdsa {
+			return false
+		}
+		keySize := (publicKey.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*keySize {
+			return false
+		}
+		hasher := hash.New()
+		hasher.Write(signingInput)
+		r := new(big.Int).SetBytes(signature[:keySize])
+		s := new(big.Int).SetBytes(signature[keySize:])
+		return ecdsa.Verify(publicKey, hasher.Sum(nil), r, s)
+	}
+
+	return false
+}
+
+func validateRegisteredClaims(claims map[string]interface{}) error {
+	now := time.Now()
+	leeway := time.Duration(jwtConfig.LeewaySeconds) * time.Second
+
+	exp, existsExp := claims["exp"].(float64)
+	if !existsExp {
+		return fmt.Errorf("token without expiration (exp) is not allowed")
+	}
+	if now.Add(-leeway).After(time.Unix(int64(exp), 0)) {
+		return fmt.Errorf("token expired")
+	}
+
+	if nbf, existsNbf := claims["nbf"].(float64); existsNbf {
+		if now.Add(leeway).Before(time.Unix(int64(nbf), 0)) {
+			return fmt.Errorf("token not valid yet")
+		}
+	}
+
+	if jwtConfig.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != jwtConfig.Issuer {
+			return fmt.Errorf("invalid token issuer")
+		}
+	}
+
+	if jwtConfig.Audience != "" {
+		audienceValid := false
+		switch aud := claims["aud"].(type) {
+		case string:
+			audienceValid = aud == jwtConfig.Audience
+		case []interface{}:
+			audienceValid = slices.Contains(aud, interface{}(jwtConfig.Audience))
+		}
+		if !audienceValid {
+			return fmt.Errorf("invalid token audience")
+		}
+	}
+
+	return nil
+}
+
+func getAuthorizationFromClaims(claims map[string]interface{}) (Authorization, error) {
+	hasuraClaims := claims
+	if jwtConfig.ClaimsNamespace != "" {
+		namespaceClaims, existsNamespace := claims[jwtConfig.ClaimsNamespace].(map[string]interface{})
+		if !existsNamespace {
+			return Authorization{}, fmt.Errorf("claims namespace %s not found in token", jwtConfig.ClaimsNamespace)
+		}
+		hasuraClaims = namespaceClaims
+	}
+
+	// Normalize the claims keys (same as the session_vars hook response)
+	sessionVariables := make(map[string]string)
+	for key, value := range hasuraClaims {
+		if !strings.HasPrefix(strings.ToLower(key), "x-hasura") {
+			continue
+		}
+		switch v := value.(type) {
+		case string:
+			sessionVariables[strings.ToLower(key)] = v
+		case float64, bool:
+			sessionVariables[strings.ToLower(key)] = fmt.Sprint(v)
+		}
+	}
+
+	authorization := Authorization{
+		MeetingId:        getStringClaim(claims, hasuraClaims, jwtConfig.MeetingIdClaim, "meetingId", "x-hasura-meetingid"),
+		UserId:           getStringClaim(claims, hasuraClaims, jwtConfig.UserIdClaim, "userId", "x-hasura-userid"),
+		SessionToken:     getStringClaim(claims, hasuraClaims, "sessionToken", "sessionToken", ""),
+		SessionVariables: sessionVariables,
+	}
+
+	return authorization, nil
+}
+
+// getStringClaim searches the claim in the root of the payload and then in the namespace
+func getStringClaim(claims map[string]interface{}, hasuraClaims map[string]interface{}, claimName string, defaultClaimName string, sessionVariableName string) string {
+	if claimName == "" {
+		claimName = defaultClaimName
+	}
+
+	for _, source := range []map[string]interface{}{claims, hasuraClaims} {
+		if value, isString := source[claimName].(string); isString && value != "" {
+			return value
+		}
+	}
+
+	if sessionVariableName != "" {
+		for key, value := range hasuraClaims {
+			if strings.EqualFold(key, sessionVariableName) {
+				if valueAsString, isString := value.(string); isString {
+					return valueAsString
+				}
+			}
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,155 @@
+package jwtauth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"time"
+)
+
+func encodeSegment(t *testing.T, value interface{}) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func signHmac(t *testing.T, alg string, secret []byte, claims map[string]interface{}) string {
+	signingInput := encodeSegment(t, map[string]string{"alg": alg, "typ": "JWT"}) + "." + encodeSegment(t, claims)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signingInput))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func signRsa(t *testing.T, privateKey *rsa.PrivateKey, claims map[string]interface{}) string {
+	signingInput := encodeSegment(t, map[string]string{"alg": "RS256", "typ": "JWT"}) + "." + encodeSegment(t, claims)
+	hash := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestVerifyToken(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKeyDer, _ := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	publicKeyPem := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKeyDer})
+
+	// Only the RSA key is configured, HS256 is allowed to check it's not used to verify the token with the public key
+	verificationKeysOnce.Do(func() {})
+	verificationKeys = []verificationKey{{key: &privateKey.PublicKey}}
+	jwtConfig.Algorithms = []string{"RS256", "HS256"}
+	jwtConfig.Audience = "bbb-graphql"
+	jwtConfig.ClaimsNamespace = ""
+
+	newClaims := func(changes map[string]interface{}) map[string]interface{} {
+		claims := map[string]interface{}{
+			"exp":          time.Now().Add(time.Hour).Unix(),
+			"aud":          "bbb-graphql",
+			"meetingId":    "meeting-1",
+			"userId":       "user-1",
+			"sessionToken": "token-1",
+		}
+		for key, value := range changes {
+			if value == nil {
+				delete(claims, key)
+			} else {
+				claims[key] = value
+			}
+		}
+		return claims
+	}
+
+	tests := []struct {
+		name                 string
+		token                string
+		sessionTokenOptional bool
+		expectedError        string
+	}{
+		{
+			name:  "valid token",
+			token: signRsa(t, privateKey, newClaims(nil)),
+		},
+		{
+			name:          "alg confusion: HS256 signed with the public key",
+			token:         signHmac(t, "HS256", publicKeyPem, newClaims(nil)),
+			expectedError: "invalid token signature",
+		},
+		{
+			name: "alg none",
+			token: encodeSegment(t, map[string]string{"alg": "none"}) + "." +
+				encodeSegment(t, newClaims(nil)) + ".",
+			expectedError: "unsigned tokens are not allowed",
+		},
+		{
+			name:          "alg not allowed",
+			token:         signHmac(t, "HS384", publicKeyPem, newClaims(nil)),
+			expectedError: "algorithm HS384 not allowed",
+		},
+		{
+			name:          "expired token",
+			token:         signRsa(t, privateKey, newClaims(map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()})),
+			expectedError: "token expired",
+		},
+		{
+			name:          "token without expiration",
+			token:         signRsa(t, privateKey, newClaims(map[string]interface{}{"exp": nil})),
+			expectedError: "token without expiration",
+		},
+		{
+			name:          "wrong audience",
+			token:         signRsa(t, privateKey, newClaims(map[string]interface{}{"aud": "other"})),
+			expectedError: "invalid token audience",
+		},
+		{
+			name:          "missing sessionToken",
+			token:         signRsa(t, privateKey, newClaims(map[string]interface{}{"sessionToken": nil})),
+			expectedError: "sessionToken missing in token claims",
+		},
+		{
+			name:                 "missing sessionToken when optional",
+			token:                signRsa(t, privateKey, newClaims(map[string]interface{}{"sessionToken": nil})),
+			sessionTokenOptional: true,
+		},
+		{
+			name:                 "other sessionToken",
+			token:                signRsa(t, privateKey, newClaims(map[string]interface{}{"sessionToken": "token-2"})),
+			sessionTokenOptional: true,
+			expectedError:        "token was not issued for this sessionToken",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jwtConfig.SessionTokenClaimOptional = tt.sessionTokenOptional
+
+			authorization, err := VerifyToken(tt.token, "token-1")
+			if tt.expectedError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.expectedError) {
+					t.Fatalf("expected error %q, got %v", tt.expectedError, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if authorization.MeetingId != "meeting-1" || authorization.UserId != "user-1" {
+				t.Errorf("unexpected authorization: %+v", authorization)
+			}
+		})
+	}
+}
@@ -0,0 +1,239 @@
+package msgpatch
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"bbb-graphql-middleware/internal/common"
+
+	evanphxjsonpatch "github.com/evanphx/json-patch"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// diffDataKeys is the key of payload.data that contains the diff of each format
+var diffDataKeys = map[common.DiffFormat]string{
+	common.DiffFormatJsonPatch:  "patch",
+	common.DiffFormatMergePatch: "mergePatch",
+	common.DiffFormatKeyedDelta: "delta",
+}
+
+// GetDiffFormat returns the format requested by the client in extensions.diffFormat, or json-patch when
+// the operation name has the prefix `Patched_`. It's empty when the client expects the full data.
+// merge-patch is downgraded to json-patch when the root field is a list, as RFC 7386 replaces lists entirely.
+func GetDiffFormat(browserMessage common.BrowserSubscribeMessage) common.DiffFormat {
+	if requestedFormat, isString := browserMessage.Payload.Extensions["diffFormat"].(string); isString {
+		diffFormat := common.DiffFormat(requestedFormat)
+		if diffFormat == common.DiffFormatMergePatch && !hasObjectRootField(browserMessage) {
+			log.Debugf("Merge patch requested by %s, that returns a list, json-patch will be used", browserMessage.Payload.OperationName)
+			return common.DiffFormatJsonPatch
+		}
+		if _, supported := diffDataKeys[diffFormat]; supported {
+			return diffFormat
+		}
+		log.Debugf("Diff format %s requested by %s is not supported", requestedFormat, browserMessage.Payload.OperationName)
+	}
+
+	if strings.HasPrefix(browserMessage.Payload.OperationName, "Patched_") {
+		return common.DiffFormatJsonPatch
+	}
+
+	return ""
+}
+
+// hasObjectRootField returns whether the root field of the subscription returns an object
+// (Hasura returns lists, except for the fields `<table>_by_pk` and `<table>_aggregate`)
+func hasObjectRootField(browserMessage common.BrowserSubscribeMessage) bool {
+	parsedOperation := common.GetParsedOperation(browserMessage.Payload.Query, browserMessage.Payload.OperationName)
+	return strings.HasSuffix(parsedOperation.RootFieldName, "_by_pk") ||
+		strings.HasSuffix(parsedOperation.RootFieldName, "_aggregate")
+}
+
+// createMergePatch creates the RFC 7386 patch of the data. It only helps object-valued data: lists are replaced
+// entirely (as defined by the RFC), so the full data is sent for top-level lists (not expected, as GetDiffFormat
+// doesn't use merge-patch for them). Keys set to null can't be represented either (null removes the key),
+// so the full data is sent when the patch would remove them.
+func createMergePatch(lastData []byte, data []byte, operationName string) []byte {
+	if isJsonList(data) {
+		common.JsonPatchFallbackCounter.With(prometheus.Labels{"operationName": operationName, "reason": "merge_patch_list"}).Inc()
+		return nil
+	}
+
+	// The data is wrapped in an object, as CreateMergePatch diffs the items of top-level arrays (not RFC 7386)
+	wrappedLastData, _ := json.Marshal(map[string]json.RawMessage{"data": lastData})
+	wrappedData, _ := json.Marshal(map[string]json.RawMessage{"data": data})
+
+	wrappedMergePatch, err := evanphxjsonpatch.CreateMergePatch(wrappedLastData, wrappedData)
+	if err != nil {
+		log.Errorf("Error creating JSON merge patch: %v", err)
+		return nil
+	}
+
+	var mergePatch map[string]json.RawMessage
+	if err := json.Unmarshal(wrappedMergePatch, &mergePatch); err != nil {
+		log.Errorf("Error unmarshalling JSON merge patch: %v", err)
+		return nil
+	}
+
+	// A null in the patch removes the key, so check that the keys set to null are kept by the client
+	if hasJsonNull(mergePatch["data"]) && !mergePatchRecreatesData(lastData, data, mergePatch["data"]) {
+		log.Debugf("Merge patch of %s can't represent the values set to null, sending the full data", operationName)
+		return nil
+	}
+
+	return mergePatch["data"]
+}
+
+func isJsonList(data []byte) bool {
+	trimmedData := bytes.TrimSpace(data)
+	return len(trimmedData) > 0 && trimmedData[0] == '['
+}
+
+// hasJsonNull returns whether the json contains a null value (not only the text null, e.g. in a string)
+func hasJsonNull(data []byte) bool {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return false
+	}
+	return containsNull(value)
+}
+
+func containsNull(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return true
+	case map[string]interface{}:
+		for _, item := range v {
+			if containsNull(item) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if containsNull(item) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func mergePatchRecreatesData(lastData []byte, data []byte, mergePatch []byte) bool {
+	patchedData, err := applyDiff(lastData, mergePatch, common.DiffFormatMergePatch)
+	if err != nil {
+		return false
+	}
+
+	var expected, got interface{}
+	if unmarshalUsingNumber(data, &expected) != nil || unmarshalUsingNumber(patchedData, &got) != nil {
+		return false
+	}
+	_, _, _, differs := findFirstDifference("", expected, got)
+	return !differs
+}
+
+// keyedDelta contains the changes of a list by id: the client removes the items of Delete,
+// replaces the items of Upsert with the same id (or appends them to the end of the list),
+// and then sorts the list following Order (only present when the order is not the result of the steps above)
+type keyedDelta struct {
+	IdField string            `json:"idField"`
+	Upsert  []json.RawMessage `json:"upsert"`
+	Delete  []interface{}     `json:"delete"`
+	Order   []interface{}     `json:"order,omitempty"`
+}
+
+// keyedList is a list of items with unique ids, keeping the json of each item
+type keyedList struct {
+	ids   []interface{}
+	items map[interface{}]json.RawMessage
+}
+
+// createKeyedDelta creates the delta by id when the list has an id field configured (json_patch_id_fields)
+func createKeyedDelta(lastData []byte, data []byte, operationName string) []byte {
+	idFieldName, hasIdField := common.GetJsonPatchIdField(operationName, data)
+	if !hasIdField {
+		return nil
+	}
+
+	lastList, reason := getKeyedList(lastData, idFieldName)
+	if reason == "" {
+		var currList keyedList
+		if currList, reason = getKeyedList(data, idFieldName); reason == "" {
+			keyedDeltaJson, _ := json.Marshal(createKeyedDeltaFromLists(lastList, currList, idFieldName))
+			return keyedDeltaJson
+		}
+	}
+
+	common.JsonPatchFallbackCounter.With(prometheus.Labels{"operationName": operationName, "reason": reason}).Inc()
+	return nil
+}
+
+func createKeyedDeltaFromLists(lastList keyedList, currList keyedList, idFieldName string) keyedDelta {
+	delta := keyedDelta{
+		IdField: idFieldName,
+		Upsert:  make([]json.RawMessage, 0),
+		Delete:  make([]interface{}, 0),
+	}
+
+	// Order of the ids after the client applies Delete and Upsert
+	resultingIds := make([]interface{}, 0, len(currList.ids))
+	for _, id := range lastList.ids {
+		if _, exists := currList.items[id]; exists {
+			resultingIds = append(resultingIds, id)
+		} else {
+			delta.Delete = append(delta.Delete, id)
+		}
+	}
+
+	for _, id := range currList.ids {
+		lastItem, existed := lastList.items[id]
+		if !existed {
+			resultingIds = append(resultingIds, id)
+		}
+		if !existed || string(lastItem) != string(currList.items[id]) {
+			delta.Upsert = append(delta.Upsert, currList.items[id])
+		}
+	}
+
+	for i, id := range currList.ids {
+		if resultingIds[i] != id {
+			delta.Order = currList.ids
+			break
+		}
+	}
+
+	return delta
+}
+
+// getKeyedList parses the list, returning the reason when it can't be diffed by id (empty when it can)
+func getKeyedList(data []byte, idFieldName string) (keyedList, string) {
+	var rawItems []json.RawMessage
+	if err := json.Unmarshal(data, &rawItems); err != nil {
+		return keyedList{}, "invalid_list"
+	}
+
+	list := keyedList{
+		ids:   make([]interface{}, 0, len(rawItems)),
+		items: make(map[interface{}]json.RawMessage, len(rawItems)),
+	}
+	for _, rawItem := range rawItems {
+		var item map[string]interface{}
+		if err := json.Unmarshal(rawItem, &item); err != nil {
+			return keyedList{}, "invalid_list"
+		}
+
+		id, existsIdField := common.GetItemId(item, idFieldName)
+		if !existsIdField {
+			return keyedList{}, "missing_id"
+		}
+		if _, exists := list.items[id]; exists {
+			return keyedList{}, "duplicated_id"
+		}
+
+		list.ids = append(list.ids, id)
+		list.items[id] = rawItem
+	}
+
+	return list, ""
+}
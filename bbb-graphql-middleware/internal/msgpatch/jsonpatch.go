@@ -1,85 +1,150 @@
 package msgpatch
 
 import (
+	"bbb-graphql-middleware/config"
 	"bbb-graphql-middleware/internal/common"
 	"encoding/json"
 	"github.com/mattbaird/jsonpatch"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
-	"strconv"
+	"strings"
+	"time"
 )
 
-var minLengthToPatch = 250    //250 chars
-var minShrinkToUsePatch = 0.5 //50% percent
+// Defaults of the thresholds, operations can override them (config patch_thresholds)
+var defaultMinLengthToPatch = 250    //250 chars
+var defaultMinShrinkToUsePatch = 0.5 //50% percent
+
+var patchThresholds = config.GetConfig().Server.PatchThresholds
+
+// getPatchThreshold returns the thresholds of the operation (without the prefix Patched_), using the defaults for the fields not set
+func getPatchThreshold(operationName string) config.PatchThreshold {
+	threshold := patchThresholds[operationName]
+	if threshold.MinLength <= 0 {
+		threshold.MinLength = defaultMinLengthToPatch
+	}
+	if threshold.MaxSizeRatio <= 0 {
+		threshold.MaxSizeRatio = defaultMinShrinkToUsePatch
+	}
+	return threshold
+}
 
 func GetPatchedMessage(
 	receivedMessage []byte,
+	operationName string,
 	dataKey string,
 	lastHasuraMessage common.HasuraMessage,
 	hasuraMessage common.HasuraMessage,
-	cacheKey uint32,
-	lastDataChecksum uint32,
-	currDataChecksum uint32) []byte {
+	cacheKey common.PatchCacheKey,
+	lastDataChecksum uint64,
+	currDataChecksum uint64) []byte {
+
+	// Operations are identified without the prefix, as in patch_thresholds (also in the metrics)
+	operationName = strings.TrimPrefix(operationName, "Patched_")
 
 	if lastDataChecksum != 0 {
-		common.JsonPatchBenchmarkingStarted(strconv.Itoa(int(cacheKey)))
-		defer common.JsonPatchBenchmarkingCompleted(strconv.Itoa(int(cacheKey)))
+		common.JsonPatchBenchmarkingStarted(cacheKey.String())
+		defer common.JsonPatchBenchmarkingCompleted(cacheKey.String())
 	}
 
-	//Lock to avoid other routines from processing the same message
-	common.GlobalCacheLocks.Lock(cacheKey)
-	if patchedMessageCache, patchedMessageCacheExists := common.GetPatchedMessageCache(cacheKey); patchedMessageCacheExists {
-		//Unlock immediately once the cache was already created by other routine
-		common.GlobalCacheLocks.Unlock(cacheKey)
-		return patchedMessageCache
+	patchedMessage := common.PatchedMessageCache.GetOrLoad(cacheKey, len(receivedMessage), func() (common.PatchedMessageCacheEntry, int) {
+		patchedMessage, isDiff := createPatchedMessage(receivedMessage, operationName, dataKey, lastHasuraMessage, hasuraMessage, cacheKey.DiffFormat, lastDataChecksum, currDataChecksum)
+		return common.PatchedMessageCacheEntry{Message: patchedMessage, IsDiff: isDiff}, len(patchedMessage)
+	})
+
+	//Counted for each connection, as the message is created once but sent to all of them
+	if patchedMessage.IsDiff {
+		common.GqlDiffMessagesCounter.With(prometheus.Labels{"operationName": operationName, "format": string(cacheKey.DiffFormat), "result": "diff"}).Inc()
+		if bytesSaved := len(receivedMessage) - len(patchedMessage.Message); bytesSaved > 0 {
+			common.GqlPatchBytesSavedCounter.With(prometheus.Labels{"operationName": operationName}).Add(float64(bytesSaved))
+		}
 	} else {
-		//It will create the cache and then Unlock (others will wait to benefit from this cache)
-		defer common.GlobalCacheLocks.Unlock(cacheKey)
+		common.GqlDiffMessagesCounter.With(prometheus.Labels{"operationName": operationName, "format": string(cacheKey.DiffFormat), "result": "full"}).Inc()
 	}
 
-	var jsonDiffPatch []byte
+	return patchedMessage.Message
+}
+
+func createPatchedMessage(
+	receivedMessage []byte,
+	operationName string,
+	dataKey string,
+	lastHasuraMessage common.HasuraMessage,
+	hasuraMessage common.HasuraMessage,
+	diffFormat common.DiffFormat,
+	lastDataChecksum uint64,
+	currDataChecksum uint64) ([]byte, bool) {
+
+	var diff []byte
+	threshold := getPatchThreshold(operationName)
 
 	if currDataChecksum == lastDataChecksum {
 		//Content didn't change, set message as null to avoid sending it to the browser
 		//This case is usual when the middleware reconnects with Hasura and receives the data again
 		jsonData, _ := json.Marshal(nil)
-		common.StorePatchedMessageCache(cacheKey, jsonData)
-		return jsonData
+		return jsonData, false
 	} else {
-		//Content was changed, creating json patch
-		//If data is small (< minLengthToPatch) it's not worth creating the patch
-		if len(hasuraMessage.Payload.Data[dataKey]) > minLengthToPatch {
+		//Content was changed, creating the diff in the format requested by the client
+		//If data is small (< threshold.MinLength) it's not worth creating the diff
+		if !threshold.Disabled && len(hasuraMessage.Payload.Data[dataKey]) > threshold.MinLength {
 			if string(lastHasuraMessage.Payload.Data[dataKey]) != "" {
-				var shouldUseCustomJsonPatch bool
-				if shouldUseCustomJsonPatch, jsonDiffPatch = common.ValidateIfShouldUseCustomJsonPatch(
-					lastHasuraMessage.Payload.Data[dataKey],
-					hasuraMessage.Payload.Data[dataKey],
-					"userId"); shouldUseCustomJsonPatch {
-					common.StorePatchedMessageCache(cacheKey, jsonDiffPatch)
-				} else if diffPatch, diffPatchErr := jsonpatch.CreatePatch(lastHasuraMessage.Payload.Data[dataKey], hasuraMessage.Payload.Data[dataKey]); diffPatchErr == nil {
-					var err error
-					if jsonDiffPatch, err = json.Marshal(diffPatch); err != nil {
-						log.Errorf("Error marshaling patch array: %v", err)
-					}
-				} else {
-					log.Errorf("Error creating JSON patch: %v\n%v", diffPatchErr, string(hasuraMessage.Payload.Data[dataKey]))
+				startedAt := time.Now()
+				switch diffFormat {
+				case common.DiffFormatMergePatch:
+					diff = createMergePatch(lastHasuraMessage.Payload.Data[dataKey], hasuraMessage.Payload.Data[dataKey], operationName)
+				case common.DiffFormatKeyedDelta:
+					diff = createKeyedDelta(lastHasuraMessage.Payload.Data[dataKey], hasuraMessage.Payload.Data[dataKey], operationName)
+				default:
+					diff = createJsonPatch(lastHasuraMessage.Payload.Data[dataKey], hasuraMessage.Payload.Data[dataKey], operationName)
 				}
+				common.GqlPatchGenerationDuration.With(prometheus.Labels{"operationName": operationName, "format": string(diffFormat)}).
+					Observe(float64(time.Since(startedAt).Microseconds()) / 1000)
 			}
 		}
 	}
 
-	//Use patch if the length is {minShrinkToUsePatch}% smaller than the original msg
-	if jsonDiffPatch != nil && float64(len(string(jsonDiffPatch)))/float64(len(string(hasuraMessage.Payload.Data[dataKey]))) < minShrinkToUsePatch {
-		//Modify receivedMessage to include the Patch and remove the previous data
+	//Use diff if the length is {threshold.MaxSizeRatio}% smaller than the original msg
+	useDiff := diff != nil && float64(len(string(diff)))/float64(len(string(hasuraMessage.Payload.Data[dataKey]))) < threshold.MaxSizeRatio
+
+	//Verify a sample of the diffs sent, falling back to the full data when enabled (config patch_verification)
+	if useDiff && shouldVerifyPatch() {
+		if !verifyDiff(lastHasuraMessage.Payload.Data[dataKey], hasuraMessage.Payload.Data[dataKey], diff, diffFormat, operationName) &&
+			config.GetConfig().Server.PatchVerification.FallbackToFull {
+			useDiff = false
+		}
+	}
+
+	if useDiff {
+		//Modify receivedMessage to include the diff and remove the previous data
 		//The key of the original message is kept to avoid errors (Apollo-client expects to receive this prop)
 
 		hasuraMessage.Payload.Data = map[string]json.RawMessage{
-			"patch": jsonDiffPatch,
-			dataKey: json.RawMessage("[]"),
+			diffDataKeys[diffFormat]: diff,
+			dataKey:                  json.RawMessage("[]"),
 		}
 		hasuraMessageJson, _ := json.Marshal(hasuraMessage)
 		receivedMessage = hasuraMessageJson
 	}
 
-	common.StorePatchedMessageCache(cacheKey, receivedMessage)
-	return receivedMessage
+	return receivedMessage, useDiff
+}
+
+// createJsonPatch creates the RFC 6902 patch, by id when the list has an id field configured (json_patch_id_fields)
+func createJsonPatch(lastData []byte, data []byte, operationName string) []byte {
+	if shouldUseCustomJsonPatch, jsonDiffPatch := common.ValidateIfShouldUseCustomJsonPatch(lastData, data, operationName); shouldUseCustomJsonPatch {
+		return jsonDiffPatch
+	}
+
+	diffPatch, diffPatchErr := jsonpatch.CreatePatch(lastData, data)
+	if diffPatchErr != nil {
+		log.Errorf("Error creating JSON patch: %v\n%v", diffPatchErr, string(data))
+		return nil
+	}
+
+	jsonDiffPatch, err := json.Marshal(diffPatch)
+	if err != nil {
+		log.Errorf("Error marshaling patch array: %v", err)
+		return nil
+	}
+	return jsonDiffPatch
 }
@@ -0,0 +1,56 @@
+package msgpatch
+
+import (
+	"encoding/json"
+
+	"bbb-graphql-middleware/internal/common"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ResendLastData handles the message `{"type":"resync","id":...}`, sent by the browser when it fails to apply a patch.
+// The last data received from Hasura is sent again in full, without restarting the subscription in Hasura.
+// It must run in its own goroutine, as it waits for the Hasura reader to send the message being handled.
+func ResendLastData(browserConnection *common.BrowserConnection, message []byte) {
+	var resyncMessage struct {
+		ID string `json:"id"`
+	}
+	_ = json.Unmarshal(message, &resyncMessage)
+
+	// Wait for the message being handled (if any), as its patch is created from the data previous to the one resent
+	browserConnection.SubscriptionsDataMutex.Lock()
+
+	browserConnection.ActiveSubscriptionsMutex.RLock()
+	subscription, exists := browserConnection.ActiveSubscriptions[resyncMessage.ID]
+	browserConnection.ActiveSubscriptionsMutex.RUnlock()
+
+	if !exists || subscription.Type != common.Subscription {
+		browserConnection.Logger.Debugf("Resync requested for %s, that is not an active subscription", resyncMessage.ID)
+		browserConnection.SubscriptionsDataMutex.Unlock()
+		common.GqlResyncCounter.With(prometheus.Labels{"operationName": "", "result": "not_found"}).Inc()
+		return
+	}
+
+	if subscription.LastReceivedData.Payload.Data == nil {
+		// Nothing was sent yet, the browser will receive the full data when Hasura sends it
+		browserConnection.SubscriptionsDataMutex.Unlock()
+		common.GqlResyncCounter.With(prometheus.Labels{"operationName": subscription.OperationName, "result": "no_data"}).Inc()
+		return
+	}
+
+	fullDataMessage := common.HasuraMessage{
+		Type: "next",
+		ID:   resyncMessage.ID,
+	}
+	fullDataMessage.Payload.Data = subscription.LastReceivedData.Payload.Data
+	fullDataMessageJson, _ := json.Marshal(fullDataMessage)
+
+	// Take the send turn before releasing the data, so the next patch is sent after this data
+	browserConnection.SubscriptionsSendMutex.Lock()
+	defer browserConnection.SubscriptionsSendMutex.Unlock()
+	browserConnection.SubscriptionsDataMutex.Unlock()
+
+	browserConnection.Logger.Debugf("Resending the last data of %s (%s)", subscription.OperationName, resyncMessage.ID)
+	browserConnection.FromHasuraToBrowserChannel.SendWait(browserConnection.Context, fullDataMessageJson)
+	common.GqlResyncCounter.With(prometheus.Labels{"operationName": subscription.OperationName, "result": "sent"}).Inc()
+}
@@ -0,0 +1,282 @@
+package msgpatch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"bbb-graphql-middleware/config"
+	"bbb-graphql-middleware/internal/common"
+
+	evanphxjsonpatch "github.com/evanphx/json-patch"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxLoggedValueLength limits the values logged on a mismatch (logged only in debug level, as they contain user data)
+const maxLoggedValueLength = 500
+
+// shouldVerifyPatch returns whether the patch is part of the sample verified (config patch_verification.sample_rate)
+func shouldVerifyPatch() bool {
+	sampleRate := config.GetConfig().Server.PatchVerification.SampleRate
+	return sampleRate > 0 && (sampleRate >= 1 || rand.Float64() < sampleRate)
+}
+
+// verifyDiff applies the diff to the previous data, as the client does, and compares the result with the new data.
+// It returns false when the diff doesn't recreate the new data, logging the path where they differ.
+func verifyDiff(lastData []byte, data []byte, diff []byte, diffFormat common.DiffFormat, operationName string) bool {
+	result := "match"
+	defer func() {
+		common.PatchVerificationCounter.With(prometheus.Labels{"operationName": operationName, "format": string(diffFormat), "result": result}).Inc()
+	}()
+
+	patchedData, err := applyDiff(lastData, diff, diffFormat)
+	if err != nil {
+		result = "error"
+		log.Errorf("Error applying %s of %s to verify it: %v", diffFormat, operationName, err)
+		log.Debugf("Patch of %s that couldn't be applied: %s", operationName, truncateForLog(diff))
+		return false
+	}
+
+	var expected, got interface{}
+	if err := unmarshalUsingNumber(data, &expected); err != nil {
+		result = "error"
+		log.Errorf("Error parsing data of %s to verify the %s: %v", operationName, diffFormat, err)
+		return false
+	}
+	if err := unmarshalUsingNumber(patchedData, &got); err != nil {
+		result = "error"
+		log.Errorf("Error parsing data patched by %s of %s: %v", diffFormat, operationName, err)
+		return false
+	}
+
+	path, expectedValue, gotValue, differs := findFirstDifference("", expected, got)
+	if !differs {
+		return true
+	}
+
+	result = "mismatch"
+	log.Errorf("The %s of %s doesn't recreate the data at %s", diffFormat, operationName, path)
+
+	// The values contain user data, so they are logged only when debugging
+	if log.IsLevelEnabled(log.DebugLevel) {
+		var previous interface{}
+		_ = unmarshalUsingNumber(lastData, &previous)
+		previousValue, existsPrevious := getValueByPointer(previous, path)
+		log.Debugf("The %s of %s doesn't recreate the data at %s\nprevious: %s\nexpected: %s\ngot: %s\npatch: %s",
+			diffFormat, operationName, path,
+			truncateForLog(marshalForLog(describeMissing(previousValue, existsPrevious))), truncateForLog(marshalForLog(expectedValue)),
+			truncateForLog(marshalForLog(gotValue)), truncateForLog(diff))
+	}
+	return false
+}
+
+func applyDiff(lastData []byte, diff []byte, diffFormat common.DiffFormat) ([]byte, error) {
+	switch diffFormat {
+	case common.DiffFormatMergePatch:
+		// Wrapped in an object like in createMergePatch, so top-level lists are replaced
+		wrappedLastData, _ := json.Marshal(map[string]json.RawMessage{"data": lastData})
+		wrappedMergePatch, _ := json.Marshal(map[string]json.RawMessage{"data": diff})
+		wrappedData, err := evanphxjsonpatch.MergePatch(wrappedLastData, wrappedMergePatch)
+		if err != nil {
+			return nil, err
+		}
+		var data map[string]json.RawMessage
+		if err := json.Unmarshal(wrappedData, &data); err != nil {
+			return nil, err
+		}
+		return data["data"], nil
+	case common.DiffFormatKeyedDelta:
+		return applyKeyedDelta(lastData, diff)
+	default:
+		patch, err := evanphxjsonpatch.DecodePatch(diff)
+		if err != nil {
+			return nil, err
+		}
+		return patch.Apply(lastData)
+	}
+}
+
+// applyKeyedDelta follows the steps described in keyedDelta: delete, upsert and then order
+func applyKeyedDelta(lastData []byte, diff []byte) ([]byte, error) {
+	var delta keyedDelta
+	if err := json.Unmarshal(diff, &delta); err != nil {
+		return nil, err
+	}
+
+	list, reason := getKeyedList(lastData, delta.IdField)
+	if reason != "" {
+		return nil, fmt.Errorf("previous data can't be keyed by %s: %s", delta.IdField, reason)
+	}
+
+	for _, id := range delta.Delete {
+		delete(list.items, id)
+	}
+	ids := make([]interface{}, 0, len(list.ids)+len(delta.Upsert))
+	for _, id := range list.ids {
+		if _, exists := list.items[id]; exists {
+			ids = append(ids, id)
+		}
+	}
+
+	for _, rawItem := range delta.Upsert {
+		var item map[string]interface{}
+		if err := json.Unmarshal(rawItem, &item); err != nil {
+			return nil, err
+		}
+		id, existsIdField := common.GetItemId(item, delta.IdField)
+		if !existsIdField {
+			return nil, errors.New("upserted item without id")
+		}
+		if _, exists := list.items[id]; !exists {
+			ids = append(ids, id)
+		}
+		list.items[id] = rawItem
+	}
+
+	if delta.Order != nil {
+		ids = delta.Order
+	}
+
+	items := make([]json.RawMessage, 0, len(ids))
+	for _, id := range ids {
+		item, exists := list.items[id]
+		if !exists {
+			return nil, fmt.Errorf("ordered id %v is not in the list", id)
+		}
+		items = append(items, item)
+	}
+	return json.Marshal(items)
+}
+
+// findFirstDifference returns the json pointer of the first value that differs, along with the values in both documents
+func findFirstDifference(path string, expected interface{}, got interface{}) (string, interface{}, interface{}, bool) {
+	switch expectedValue := expected.(type) {
+	case map[string]interface{}:
+		gotValue, isMap := got.(map[string]interface{})
+		if !isMap {
+			return path, expected, got, true
+		}
+		keys := make([]string, 0, len(expectedValue)+len(gotValue))
+		for key := range expectedValue {
+			keys = append(keys, key)
+		}
+		for key := range gotValue {
+			if _, exists := expectedValue[key]; !exists {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			keyPath := path + "/" + escapePointerToken(key)
+			expectedItem, existsExpected := expectedValue[key]
+			gotItem, existsGot := gotValue[key]
+			// A missing key differs from a key set to null (e.g. merge-patch removes the keys set to null)
+			if existsExpected != existsGot {
+				return keyPath, describeMissing(expectedItem, existsExpected), describeMissing(gotItem, existsGot), true
+			}
+			if diffPath, e, g, differs := findFirstDifference(keyPath, expectedItem, gotItem); differs {
+				return diffPath, e, g, true
+			}
+		}
+		return "", nil, nil, false
+	case []interface{}:
+		gotValue, isList := got.([]interface{})
+		if !isList {
+			return path, expected, got, true
+		}
+		for i := 0; i < len(expectedValue) && i < len(gotValue); i++ {
+			if diffPath, e, g, differs := findFirstDifference(path+"/"+strconv.Itoa(i), expectedValue[i], gotValue[i]); differs {
+				return diffPath, e, g, true
+			}
+		}
+		if len(expectedValue) != len(gotValue) {
+			return path, expected, got, true
+		}
+		return "", nil, nil, false
+	case json.Number:
+		// Compared by value, as the same number can be written differently (e.g. 1.0 and 1)
+		gotValue, isNumber := got.(json.Number)
+		if !isNumber || !equalNumbers(expectedValue, gotValue) {
+			return path, expected, got, true
+		}
+		return "", nil, nil, false
+	default:
+		if !reflect.DeepEqual(expected, got) {
+			return path, expected, got, true
+		}
+		return "", nil, nil, false
+	}
+}
+
+func equalNumbers(a json.Number, b json.Number) bool {
+	if a == b {
+		return true
+	}
+	aValue, okA := new(big.Rat).SetString(string(a))
+	bValue, okB := new(big.Rat).SetString(string(b))
+	return okA && okB && aValue.Cmp(bValue) == 0
+}
+
+// describeMissing replaces the value of a missing key in the logs, to distinguish it from null
+func describeMissing(value interface{}, exists bool) interface{} {
+	if !exists {
+		return "(missing)"
+	}
+	return value
+}
+
+func getValueByPointer(value interface{}, path string) (interface{}, bool) {
+	if path == "" {
+		return value, true
+	}
+	for _, token := range strings.Split(path[1:], "/") {
+		token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+		switch v := value.(type) {
+		case map[string]interface{}:
+			item, exists := v[token]
+			if !exists {
+				return nil, false
+			}
+			value = item
+		case []interface{}:
+			index, err := strconv.Atoi(token)
+			if err != nil || index < 0 || index >= len(v) {
+				return nil, false
+			}
+			value = v[index]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+func escapePointerToken(token string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1")
+}
+
+func unmarshalUsingNumber(data []byte, value interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(value)
+}
+
+func marshalForLog(value interface{}) []byte {
+	valueJson, _ := json.Marshal(value)
+	return valueJson
+}
+
+func truncateForLog(value []byte) string {
+	if len(value) > maxLoggedValueLength {
+		return string(value[:maxLoggedValueLength]) + "..."
+	}
+	return string(value)
+}
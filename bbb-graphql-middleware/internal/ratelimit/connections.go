@@ -0,0 +1,206 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"bbb-graphql-middleware/internal/common"
+
+	"github.com/redis/go-redis/v9"
+	log "github.com/sirupsen/logrus"
+)
+
+// ConnectionsCounter controls the limits max_connections and max_connections_per_session_token
+type ConnectionsCounter interface {
+	HasReachedMaxGlobalConnections() bool
+	HasReachedMaxUserConnections(sessionToken string) bool
+	AddUserConnection(sessionToken string, browserConnectionId string)
+	RemoveUserConnection(sessionToken string, browserConnectionId string)
+}
+
+var (
+	connectionsCounter     ConnectionsCounter
+	connectionsCounterOnce sync.Once
+)
+
+// GetConnectionsCounter returns the Redis-backed counter when distributed limits are enabled, otherwise the local one
+func GetConnectionsCounter() ConnectionsCounter {
+	connectionsCounterOnce.Do(func() {
+		if distributedLimitsEnabled {
+			redisCounter := &redisConnectionsCounter{connections: make(map[string]string)}
+			go redisCounter.refreshConnectionsRoutine()
+			connectionsCounter = redisCounter
+		} else {
+			connectionsCounter = &localConnectionsCounter{}
+		}
+	})
+
+	return connectionsCounter
+}
+
+// localConnectionsCounter counts only the connections of this instance
+type localConnectionsCounter struct{}
+
+func (c *localConnectionsCounter) HasReachedMaxGlobalConnections() bool {
+	return common.HasReachedMaxGlobalConnections()
+}
+
+func (c *localConnectionsCounter) HasReachedMaxUserConnections(sessionToken string) bool {
+	return common.HasReachedMaxUserConnections(sessionToken)
+}
+
+func (c *localConnectionsCounter) AddUserConnection(sessionToken string, _ string) {
+	common.AddUserConnection(sessionToken)
+}
+
+func (c *localConnectionsCounter) RemoveUserConnection(sessionToken string, _ string) {
+	common.RemoveUserConnection(sessionToken)
+}
+
+// The connections are stored in sorted sets (the global one and one per sessionToken), where the member is
+// the instance id along with the connection id and the score is when it expires (Redis time, in ms).
+// Each instance refreshes its connections periodically, so the connections of instances that died,
+// or whose removal failed, expire on their own.
+var countConnectionsScript = redis.NewScript(`
+local now = redis.call('TIME')
+now = tonumber(now[1]) * 1000 + math.floor(tonumber(now[2]) / 1000)
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now)
+return redis.call('ZCARD', KEYS[1])
+`)
+
+// KEYS[1] is the global key and KEYS[i] the sessionToken key of the connection ARGV[i] (i > 1), ARGV[1] is the ttl in ms
+var refreshConnectionsScript = redis.NewScript(`
+local now = redis.call('TIME')
+now = tonumber(now[1]) * 1000 + math.floor(tonumber(now[2]) / 1000)
+local ttl = tonumber(ARGV[1])
+for i = 2, #ARGV do
+	redis.call('ZADD', KEYS[1], now + ttl, ARGV[i])
+	redis.call('ZADD', KEYS[i], now + ttl, ARGV[i])
+	redis.call('PEXPIRE', KEYS[i], ttl)
+end
+redis.call('PEXPIRE', KEYS[1], ttl)
+return 1
+`)
+
+// Connections not refreshed within connectionTtl are not counted anymore
+var connectionTtl = 30 * time.Second
+var connectionsRefreshInterval = 10 * time.Second
+
+// redisConnectionsCounter counts the connections of all instances, the local counters are kept as fallback
+type redisConnectionsCounter struct {
+	connections      map[string]string // sessionToken of each connection of this instance, by connection id
+	connectionsMutex sync.Mutex
+}
+
+func getConnectionMember(browserConnectionId string) string {
+	return common.GetUniqueID() + ":" + browserConnectionId
+}
+
+func (c *redisConnectionsCounter) countConnections(key string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisCallTimeout)
+	defer cancel()
+
+	return countConnectionsScript.Run(ctx, getRedisConn(), []string{key}).Int()
+}
+
+// refreshConnections adds the connections to the sorted sets, or postpones their expiration when they exist
+func (c *redisConnectionsCounter) refreshConnections(connections map[string]string) error {
+	if len(connections) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisCallTimeout)
+	defer cancel()
+
+	keys := make([]string, 0, len(connections)+1)
+	args := make([]interface{}, 0, len(connections)+1)
+	keys = append(keys, getKey("active_connections"))
+	args = append(args, connectionTtl.Milliseconds())
+	for browserConnectionId, sessionToken := range connections {
+		keys = append(keys, getKey("active_connections", sessionToken))
+		args = append(args, getConnectionMember(browserConnectionId))
+	}
+
+	return refreshConnectionsScript.Run(ctx, getRedisConn(), keys, args...).Err()
+}
+
+func (c *redisConnectionsCounter) refreshConnectionsRoutine() {
+	for {
+		time.Sleep(connectionsRefreshInterval)
+
+		c.connectionsMutex.Lock()
+		connections := make(map[string]string, len(c.connections))
+		for browserConnectionId, sessionToken := range c.connections {
+			connections[browserConnectionId] = sessionToken
+		}
+		c.connectionsMutex.Unlock()
+
+		if err := c.refreshConnections(connections); err != nil {
+			log.WithField("_routine", "ratelimit").Warnf("failed to refresh the connections on Redis: %v", err)
+		}
+	}
+}
+
+func (c *redisConnectionsCounter) HasReachedMaxGlobalConnections() bool {
+	if common.GetMaxConnectionsGlobal() == 0 {
+		return true
+	}
+
+	numOfConn, err := c.countConnections(getKey("active_connections"))
+	if err != nil {
+		fallbackToLocal("global_connections", err)
+		return common.HasReachedMaxGlobalConnections()
+	}
+
+	return numOfConn >= common.GetMaxConnectionsGlobal()
+}
+
+func (c *redisConnectionsCounter) HasReachedMaxUserConnections(sessionToken string) bool {
+	if common.GetMaxConnectionsPerSessionToken() == 0 {
+		return true
+	}
+
+	numOfConn, err := c.countConnections(getKey("active_connections", sessionToken))
+	if err != nil {
+		fallbackToLocal("user_connections", err)
+		return common.HasReachedMaxUserConnections(sessionToken)
+	}
+
+	return numOfConn >= common.GetMaxConnectionsPerSessionToken()
+}
+
+func (c *redisConnectionsCounter) AddUserConnection(sessionToken string, browserConnectionId string) {
+	common.AddUserConnection(sessionToken)
+
+	c.connectionsMutex.Lock()
+	c.connections[browserConnectionId] = sessionToken
+	c.connectionsMutex.Unlock()
+
+	// When it fails, the connection is added on the next refresh
+	if err := c.refreshConnections(map[string]string{browserConnectionId: sessionToken}); err != nil {
+		fallbackToLocal("add_connection", err)
+	}
+}
+
+func (c *redisConnectionsCounter) RemoveUserConnection(sessionToken string, browserConnectionId string) {
+	common.RemoveUserConnection(sessionToken)
+
+	c.connectionsMutex.Lock()
+	delete(c.connections, browserConnectionId)
+	c.connectionsMutex.Unlock()
+
+	// When it fails, the connection expires as it's not refreshed anymore
+	ctx, cancel := context.WithTimeout(context.Background(), redisCallTimeout)
+	defer cancel()
+
+	member := getConnectionMember(browserConnectionId)
+	_, err := getRedisConn().Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRem(ctx, getKey("active_connections"), member)
+		pipe.ZRem(ctx, getKey("active_connections", sessionToken), member)
+		return nil
+	})
+	if err != nil {
+		fallbackToLocal("remove_connection", err)
+	}
+}
@@ -0,0 +1,161 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"bbb-graphql-middleware/internal/common"
+
+	"github.com/redis/go-redis/v9"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+// Token bucket shared among the middleware instances.
+// Tokens can go negative (reservation), the caller receives how long it should wait for its token.
+// It returns -1 (and reserves nothing) when the wait would be longer than the max wait informed.
+var tokenBucketScript = redis.NewScript(`
+local now = redis.call('TIME')
+now = tonumber(now[1]) * 1000 + math.floor(tonumber(now[2]) / 1000)
+local interval = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local maxWait = tonumber(ARGV[3])
+
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(bucket[1])
+local ts = tonumber(bucket[2])
+if tokens == nil or ts == nil then
+	tokens = burst
+	ts = now
+end
+
+tokens = math.min(burst, tokens + (now - ts) / interval) - 1
+local wait = 0
+if tokens < 0 then
+	wait = math.ceil(-tokens * interval)
+end
+if wait > maxWait then
+	return -1
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], ARGV[4])
+return wait
+`)
+
+// Gives back the token reserved by a caller that stopped waiting for it (context canceled before its turn)
+var tokenRefundScript = redis.NewScript(`
+local tokens = tonumber(redis.call('HGET', KEYS[1], 'tokens'))
+if tokens ~= nil then
+	redis.call('HSET', KEYS[1], 'tokens', tostring(math.min(tonumber(ARGV[1]), tokens + 1)))
+end
+return 0
+`)
+
+// NewConnectionLimiter returns a limiter of the connection allowing perMinute events with the given burst.
+// When distributed limits are enabled, the bucket is stored in Redis under the client session and the limiterKey,
+// so it is shared with other instances (e.g. when the client reconnects to another middleware).
+// It can be created before the connection is authorized, the local bucket is used until the session is known.
+func NewConnectionLimiter(bc *common.BrowserConnection, limiterKey string, perMinute int, burst int) common.RateLimiter {
+	localLimiter := newLocalLimiter(perMinute, burst)
+
+	if !distributedLimitsEnabled || perMinute <= 0 {
+		return localLimiter
+	}
+
+	return &redisLimiter{
+		keyFunc: func() string {
+			bc.RLock()
+			defer bc.RUnlock()
+			if bc.SessionToken == "" {
+				return ""
+			}
+			return getKey("ratelimit", bc.SessionToken, bc.ClientSessionUUID, limiterKey)
+		},
+		interval:     time.Minute / time.Duration(perMinute),
+		burst:        burst,
+		localLimiter: localLimiter,
+	}
+}
+
+func newLocalLimiter(perMinute int, burst int) *rate.Limiter {
+	if perMinute <= 0 {
+		return rate.NewLimiter(rate.Inf, burst)
+	}
+
+	return rate.NewLimiter(rate.Every(time.Minute/time.Duration(perMinute)), burst)
+}
+
+type redisLimiter struct {
+	keyFunc      func() string // key of the bucket, empty while it's not known
+	interval     time.Duration
+	burst        int
+	localLimiter *rate.Limiter // used when Redis is unreachable
+}
+
+func (l *redisLimiter) Wait(ctx context.Context) error {
+	key := l.keyFunc()
+	if key == "" {
+		return l.localLimiter.Wait(ctx)
+	}
+
+	maxWait := time.Hour
+	if deadline, hasDeadline := ctx.Deadline(); hasDeadline {
+		maxWait = time.Until(deadline)
+	}
+
+	redisCtx, cancel := context.WithTimeout(ctx, redisCallTimeout)
+	defer cancel()
+
+	intervalInMs := float64(l.interval) / float64(time.Millisecond)
+	bucketTtl := time.Duration(l.burst)*l.interval + time.Minute
+
+	waitInMs, err := tokenBucketScript.Run(
+		redisCtx,
+		getRedisConn(),
+		[]string{key},
+		strconv.FormatFloat(intervalInMs, 'f', -1, 64),
+		l.burst,
+		maxWait.Milliseconds(),
+		bucketTtl.Milliseconds(),
+	).Int64()
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		fallbackToLocal("rate_limit", err)
+		return l.localLimiter.Wait(ctx)
+	}
+
+	if waitInMs < 0 {
+		return fmt.Errorf("rate: Wait would exceed context deadline")
+	}
+
+	if waitInMs == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(time.Duration(waitInMs) * time.Millisecond)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		l.refund(key)
+		return ctx.Err()
+	}
+}
+
+// refund gives back the token reserved, so the canceled wait doesn't delay the next callers
+func (l *redisLimiter) refund(key string) {
+	refundCtx, cancel := context.WithTimeout(context.Background(), redisCallTimeout)
+	defer cancel()
+
+	if err := tokenRefundScript.Run(refundCtx, getRedisConn(), []string{key}, l.burst).Err(); err != nil {
+		log.WithField("_routine", "ratelimit").Debugf("failed to refund the token of %s on Redis: %v", key, err)
+	}
+}
@@ -0,0 +1,109 @@
+package ratelimit
+
+import (
+	"strings"
+
+	"bbb-graphql-middleware/config"
+	"bbb-graphql-middleware/internal/common"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const DefaultPolicyName = "default"
+
+var operationPolicies = config.GetConfig().Server.OperationPolicies
+
+// OperationPolicy contains the limits that apply to a given operation of a connection
+type OperationPolicy struct {
+	Name          string // name of the policy found in operation_policies, or `default`
+	RatePerMinute int
+	MaxLength     int
+	MaxDepth      int
+	RateLimiter   common.RateLimiter
+}
+
+// Reject records the rejection of an operation by this policy
+func (p OperationPolicy) Reject(reason string) {
+	common.OperationPolicyRejectedCounter.With(prometheus.Labels{"policy": p.Name, "reason": reason}).Inc()
+}
+
+// GetQueryPolicy returns the policy of a query or subscription sent to Hasura
+func GetQueryPolicy(bc *common.BrowserConnection, operationName string) OperationPolicy {
+	cfg := config.GetConfig()
+	defaultPolicy := OperationPolicy{
+		Name:          DefaultPolicyName,
+		RatePerMinute: cfg.Server.MaxConnectionQueriesPerMinute,
+		MaxLength:     cfg.Server.MaxQueryLength,
+		MaxDepth:      cfg.Server.MaxQueryDepth,
+		RateLimiter:   bc.FromBrowserToHasuraRateLimiter,
+	}
+
+	return getOperationPolicy(bc, "queries", defaultPolicy, operationName, strings.TrimPrefix(operationName, "Patched_"))
+}
+
+// GetMutationPolicy returns the policy of a mutation, searching first by its action name and then by its operation name
+func GetMutationPolicy(bc *common.BrowserConnection, actionName string, operationName string) OperationPolicy {
+	cfg := config.GetConfig()
+	defaultPolicy := OperationPolicy{
+		Name:          DefaultPolicyName,
+		RatePerMinute: cfg.Server.MaxConnectionMutationsPerMinute,
+		MaxLength:     cfg.Server.MaxMutationLength,
+		MaxDepth:      0,
+		RateLimiter:   bc.FromBrowserToGqlActionsRateLimiter,
+	}
+
+	return getOperationPolicy(bc, "mutations", defaultPolicy, actionName, operationName)
+}
+
+func getOperationPolicy(bc *common.BrowserConnection, kind string, defaultPolicy OperationPolicy, names ...string) OperationPolicy {
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+
+		policyConfig, existsPolicy := operationPolicies[name]
+		if !existsPolicy {
+			continue
+		}
+
+		policy := defaultPolicy
+		policy.Name = name
+		if policyConfig.MaxLength > 0 {
+			policy.MaxLength = policyConfig.MaxLength
+		}
+		if policyConfig.MaxDepth > 0 {
+			policy.MaxDepth = policyConfig.MaxDepth
+		}
+		if policyConfig.RatePerMinute > 0 {
+			policy.RatePerMinute = policyConfig.RatePerMinute
+			burst := policyConfig.Burst
+			if burst <= 0 {
+				burst = policyConfig.RatePerMinute
+			}
+			policy.RateLimiter = GetConnectionRateLimiter(bc, kind+":"+name, policyConfig.RatePerMinute, burst)
+		}
+
+		return policy
+	}
+
+	return defaultPolicy
+}
+
+// GetConnectionRateLimiter returns the limiter of the connection identified by limiterKey, creating it on the first call.
+// It's kept while the connection lives, and it's keyed by the client session in Redis (see NewConnectionLimiter).
+func GetConnectionRateLimiter(bc *common.BrowserConnection, limiterKey string, perMinute int, burst int) common.RateLimiter {
+	bc.OperationRateLimitersMutex.Lock()
+	defer bc.OperationRateLimitersMutex.Unlock()
+
+	if bc.OperationRateLimiters == nil {
+		bc.OperationRateLimiters = make(map[string]common.RateLimiter)
+	}
+
+	if rateLimiter, exists := bc.OperationRateLimiters[limiterKey]; exists {
+		return rateLimiter
+	}
+
+	rateLimiter := NewConnectionLimiter(bc, limiterKey, perMinute, burst)
+	bc.OperationRateLimiters[limiterKey] = rateLimiter
+	return rateLimiter
+}
@@ -0,0 +1,50 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+
+	"bbb-graphql-middleware/config"
+	"bbb-graphql-middleware/internal/common"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	distributedLimitsEnabled = config.GetConfig().Redis.DistributedLimitsEnabled
+	keyPrefix                = config.GetConfig().Redis.DistributedLimitsKeyPrefix
+)
+
+// Timeout of each Redis call, after that the local limits are used
+var redisCallTimeout = 500 * time.Millisecond
+
+var (
+	redisClient     *redis.Client
+	redisClientOnce sync.Once
+)
+
+func getRedisConn() *redis.Client {
+	redisClientOnce.Do(func() {
+		redisClient = common.NewRedisClient()
+	})
+
+	return redisClient
+}
+
+func getKey(parts ...string) string {
+	key := keyPrefix
+	if key == "" {
+		key = "graphql-middleware"
+	}
+	for _, part := range parts {
+		key += ":" + part
+	}
+	return key
+}
+
+func fallbackToLocal(operation string, err error) {
+	log.WithField("_routine", "ratelimit").Debugf("Redis unreachable on %s, using local limits: %v", operation, err)
+	common.DistributedLimitsFallbackCounter.With(prometheus.Labels{"operation": operation}).Inc()
+}
@@ -17,13 +17,16 @@ import (
 	"bbb-graphql-middleware/internal/common"
 	"bbb-graphql-middleware/internal/gql_actions"
 	"bbb-graphql-middleware/internal/hasura"
+	"bbb-graphql-middleware/internal/jwtauth"
+	"bbb-graphql-middleware/internal/ratelimit"
 	"bbb-graphql-middleware/internal/websrv/reader"
 	"bbb-graphql-middleware/internal/websrv/writer"
+	"bbb-graphql-middleware/internal/wscompression"
+	"bbb-graphql-middleware/internal/wsencoding"
 
 	"github.com/coder/websocket"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
-	"golang.org/x/time/rate"
 )
 
 var lastBrowserConnectionId atomic.Int64
@@ -31,6 +34,9 @@ var lastBrowserConnectionId atomic.Int64
 // Buffer size of the channels
 var bufferSize = 100
 
+// Bytes sent and received through the network by the browser connections
+var browserWireBytesCounter = common.NewWireBytesCounter(common.WsConnectionBrowser)
+
 // active browser connections
 var (
 	BrowserConnections      = make(map[string]*common.BrowserConnection)
@@ -58,31 +64,50 @@ func ConnectionHandler(w http.ResponseWriter, r *http.Request) {
 	browserConnectionId := "BC" + fmt.Sprintf("%010d", lastBrowserConnectionId.Load())
 	connectionLogger := newLogger.WithField("browserConnectionId", browserConnectionId)
 
+	// Identify the origin of the request and the policy (authorized_cross_origins) that authorizes it
+	origin, originPolicy, originAuthorized := findOriginPolicy(r)
+	if origin != "" {
+		connectionLogger = connectionLogger.WithField("origin", origin)
+	}
+	originLabel := originPolicy.Pattern
+	if !originAuthorized {
+		originLabel = "unauthorized"
+	}
+
 	// Starts a context that will be dependent on the connection, so we can cancel subroutines when the connection is dropped
 	browserConnectionContext, browserConnectionContextCancel := context.WithCancel(r.Context())
 	defer browserConnectionContextCancel()
 
-	// Add sub-protocol
+	// Add sub-protocols (json and msgpack)
 	var acceptOptions websocket.AcceptOptions
-	acceptOptions.Subprotocols = append(acceptOptions.Subprotocols, "graphql-transport-ws")
+	acceptOptions.Subprotocols = append(acceptOptions.Subprotocols, wsencoding.GetSubprotocols()...)
 
-	// Add Authorized Cross Origin Url
-	if config.GetConfig().Server.AuthorizedCrossOrigin != "" {
-		acceptOptions.OriginPatterns = append(acceptOptions.OriginPatterns, config.GetConfig().Server.AuthorizedCrossOrigin)
-	}
+	// Add Authorized Cross Origin Urls
+	acceptOptions.OriginPatterns = append(acceptOptions.OriginPatterns, getAuthorizedOriginPatterns()...)
+
+	// Add compression (used only when the browser supports it)
+	wscompression.SetAcceptOptions(&acceptOptions)
 
-	browserWsConn, err := websocket.Accept(w, r, &acceptOptions)
+	// Count the bytes sent through the network, to compare them with the size of the messages
+	browserWsConn, err := websocket.Accept(wscompression.NewCountingResponseWriter(w, browserWireBytesCounter), r, &acceptOptions)
 	if err != nil {
+		if !originAuthorized {
+			common.WsConnectionRejectedCounter.With(prometheus.Labels{"reason": "request Origin is not authorized", "origin": originLabel}).Inc()
+		}
 		connectionLogger.Errorf("error: %v", err)
 		http.Error(w, "Closing browser connection, reason: request Origin is not authorized", http.StatusForbidden)
 		return
 	}
 	browserWsConn.SetReadLimit(9999999) // 10MB
 
+	if wscompression.RecordNegotiation(common.WsConnectionBrowser, config.GetConfig().Server.Compression.Mode, w.Header()) {
+		connectionLogger = connectionLogger.WithField("compression", config.GetConfig().Server.Compression.Mode)
+	}
+
 	connectionLogger.Infof("browser connection accepted")
 
-	if common.HasReachedMaxGlobalConnections() {
-		common.WsConnectionRejectedCounter.With(prometheus.Labels{"reason": "limit of server connections exceeded"}).Inc()
+	if ratelimit.GetConnectionsCounter().HasReachedMaxGlobalConnections() {
+		common.WsConnectionRejectedCounter.With(prometheus.Labels{"reason": "limit of server connections exceeded", "origin": originLabel}).Inc()
 		disconnectWithError(
 			browserWsConn,
 			browserConnectionContext,
@@ -94,26 +119,46 @@ func ConnectionHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !tryAddOriginConnection(originPolicy) {
+		common.WsConnectionRejectedCounter.With(prometheus.Labels{"reason": "limit of origin connections exceeded", "origin": originLabel}).Inc()
+		disconnectWithError(
+			browserWsConn,
+			browserConnectionContext,
+			browserConnectionContextCancel,
+			websocket.StatusInternalError,
+			"connections_limit_exceeded",
+			"limit of origin connections exceeded",
+			connectionLogger)
+		return
+	}
+	defer removeOriginConnection(originPolicy)
+
 	defer browserWsConn.Close(websocket.StatusInternalError, "closing websocket connection as the function ended")
 
 	thisConnection := common.BrowserConnection{
-		Id:                                 browserConnectionId,
-		Websocket:                          browserWsConn,
-		BrowserRequestCookies:              r.Cookies(),
-		ActiveSubscriptions:                make(map[string]common.GraphQlSubscription, 1),
-		ActiveStreamings:                   make(map[string][]string, 1),
-		Context:                            browserConnectionContext,
-		ContextCancelFunc:                  browserConnectionContextCancel,
-		ConnAckSentToBrowser:               false,
-		FromBrowserToHasuraChannel:         common.NewSafeChannelByte(bufferSize),
-		FromBrowserToHasuraRateLimiter:     rate.NewLimiter(rate.Every(time.Minute/time.Duration(cfg.Server.MaxConnectionQueriesPerMinute)), cfg.Server.MaxConnectionQueriesPerMinute),
-		FromBrowserToGqlActionsChannel:     common.NewSafeChannelByte(bufferSize),
-		FromBrowserToGqlActionsRateLimiter: rate.NewLimiter(rate.Every(time.Minute/time.Duration(cfg.Server.MaxConnectionMutationsPerMinute)), cfg.Server.MaxConnectionMutationsPerMinute),
-		FromHasuraToBrowserChannel:         common.NewSafeChannelByte(bufferSize),
-		LastBrowserMessageTime:             time.Now(),
-		Logger:                             connectionLogger,
+		Id:                              browserConnectionId,
+		Websocket:                       browserWsConn,
+		BrowserRequestCookies:           r.Cookies(),
+		Origin:                          origin,
+		OriginPolicy:                    originPolicy,
+		ActiveSubscriptions:             make(map[string]common.GraphQlSubscription, 1),
+		ActiveStreamings:                make(map[string][]string, 1),
+		Context:                         browserConnectionContext,
+		ContextCancelFunc:               browserConnectionContextCancel,
+		ConnAckSentToBrowser:            false,
+		FromBrowserToHasuraChannel:      common.NewSafeChannelByte(bufferSize),
+		FromBrowserToGqlActionsChannels: gql_actions.NewLaneChannels(bufferSize),
+		FromHasuraToBrowserChannel:      common.NewSafeChannelByte(bufferSize),
+		OperationRateLimiters:           make(map[string]common.RateLimiter),
+		LastBrowserMessageTime:          time.Now(),
+		Logger:                          connectionLogger,
 	}
 
+	// Rate limiters are keyed by the client session, so they are kept when it reconnects (even to another instance).
+	// They are created before reading the browser messages, the session is set by connectionInitHandler.
+	thisConnection.FromBrowserToHasuraRateLimiter = ratelimit.NewConnectionLimiter(&thisConnection, "queries", cfg.Server.MaxConnectionQueriesPerMinute, cfg.Server.MaxConnectionQueriesPerMinute)
+	thisConnection.FromBrowserToGqlActionsRateLimiter = ratelimit.NewConnectionLimiter(&thisConnection, "mutations", cfg.Server.MaxConnectionMutationsPerMinute, cfg.Server.MaxConnectionMutationsPerMinute)
+
 	BrowserConnectionsMutex.Lock()
 	BrowserConnections[browserConnectionId] = &thisConnection
 	BrowserConnectionsMutex.Unlock()
@@ -156,7 +201,7 @@ func ConnectionHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Check authorization and obtain user session variables from bbb-web
 	if errorOnInitConnection, errorMessageId := connectionInitHandler(&thisConnection); errorOnInitConnection != nil {
-		common.WsConnectionRejectedCounter.With(prometheus.Labels{"reason": errorOnInitConnection.Error()}).Inc()
+		common.WsConnectionRejectedCounter.With(prometheus.Labels{"reason": errorOnInitConnection.Error(), "origin": originLabel}).Inc()
 		disconnectWithError(
 			browserWsConn,
 			browserConnectionContext,
@@ -171,8 +216,8 @@ func ConnectionHandler(w http.ResponseWriter, r *http.Request) {
 
 	common.WsConnectionAcceptedCounter.Inc()
 
-	common.AddUserConnection(thisConnection.SessionToken)
-	defer common.RemoveUserConnection(thisConnection.SessionToken)
+	ratelimit.GetConnectionsCounter().AddUserConnection(thisConnection.SessionToken, browserConnectionId)
+	defer ratelimit.GetConnectionsCounter().RemoveUserConnection(thisConnection.SessionToken, browserConnectionId)
 
 	// Ensure a hasura client is running while the browser is connected
 	go func() {
@@ -237,6 +282,9 @@ func ConnectionHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func InvalidateSessionTokenHasuraConnections(sessionTokenToInvalidate string) {
+	// Session variables (and authorization) may have changed, so cached hook results can't be used anymore
+	invalidateSessionTokenHooksCache(sessionTokenToInvalidate)
+
 	BrowserConnectionsMutex.RLock()
 	connectionsToProcess := make([]*common.BrowserConnection, 0)
 	for _, browserConnection := range BrowserConnections {
@@ -286,6 +334,8 @@ func invalidateHasuraConnectionForSessionToken(browserConnection *common.Browser
 }
 
 func InvalidateSessionTokenBrowserConnections(sessionTokenToInvalidate string, reasonMsgId string, reason string) {
+	invalidateSessionTokenHooksCache(sessionTokenToInvalidate)
+
 	BrowserConnectionsMutex.RLock()
 	connectionsToProcess := make([]*common.BrowserConnection, 0)
 	for _, browserConnection := range BrowserConnections {
@@ -326,6 +376,16 @@ func invalidateBrowserConnectionForSessionToken(bc *common.BrowserConnection, se
 	go SendUserGraphqlDisconnectionForcedEvtMsg(sessionToken)
 }
 
+func invalidateSessionTokenHooksCache(sessionToken string) {
+	bbb_web.InvalidateAuthorizationCache(sessionToken)
+	akka_apps.InvalidateSessionVariablesCache(sessionToken)
+}
+
+func InvalidateMeetingHooksCache(meetingId string) {
+	bbb_web.InvalidateMeetingAuthorizationCache(meetingId)
+	akka_apps.InvalidateMeetingSessionVariablesCache(meetingId)
+}
+
 func refreshUserSessionVariables(browserConnection *common.BrowserConnection) (error, string) {
 	// Check authorization
 	sessionVariables, err, errorId := akka_apps.AkkaAppsGetSessionVariablesFrom(browserConnection.Id, browserConnection.SessionToken, browserConnection.ClientSessionUUID)
@@ -336,6 +396,10 @@ func refreshUserSessionVariables(browserConnection *common.BrowserConnection) (e
 		browserConnection.Logger.Trace("Session variables obtained successfully")
 	}
 
+	return setUserSessionVariables(browserConnection, sessionVariables)
+}
+
+func setUserSessionVariables(browserConnection *common.BrowserConnection, sessionVariables map[string]string) (error, string) {
 	hasuraRole, existsHasuraRole := sessionVariables["x-hasura-role"]
 	if !existsHasuraRole {
 		return fmt.Errorf("error on checking sessionToken authorization, X-Hasura-Role is missing"), "param_missing"
@@ -377,7 +441,7 @@ func connectionInitHandler(browserConnection *common.BrowserConnection) (error,
 			}
 			browserConnection.Logger = browserConnection.Logger.WithField("sessionToken", sessionToken)
 
-			if common.HasReachedMaxUserConnections(sessionToken) {
+			if ratelimit.GetConnectionsCounter().HasReachedMaxUserConnections(sessionToken) {
 				return fmt.Errorf("too many connections"), "too_many_connections"
 			}
 
@@ -392,6 +456,10 @@ func connectionInitHandler(browserConnection *common.BrowserConnection) (error,
 				return fmt.Errorf("X-ClientType header missing on init connection"), "param_missing"
 			}
 
+			if !isClientTypeAllowedForOrigin(browserConnection.OriginPolicy, clientType) {
+				return fmt.Errorf("client type not allowed for this origin"), "client_type_not_allowed"
+			}
+
 			clientIsMobile, existsMobile := headersAsMap["X-ClientIsMobile"].(string)
 			if !existsMobile {
 				return fmt.Errorf("X-ClientIsMobile header missing on init connection"), "param_missing"
@@ -400,9 +468,25 @@ func connectionInitHandler(browserConnection *common.BrowserConnection) (error,
 			var meetingId, userId string
 			var errCheckAuthorization error
 
-			// Check authorization
+			// Check authorization using the JWT sent in the headers (when auth_jwt is enabled)
+			var jwtAuthorization *jwtauth.Authorization
+			if jwtauth.Enabled() {
+				if authorization, err := checkJwtAuthorization(headersAsMap, sessionToken); err == nil {
+					jwtAuthorization = &authorization
+					meetingId = authorization.MeetingId
+					userId = authorization.UserId
+					browserConnection.Logger.Trace("Success on check JWT authorization")
+				} else if jwtauth.FallbackToHooks() {
+					browserConnection.Logger.Warnf("JWT authorization failed, using auth hook instead: %v", err)
+				} else {
+					browserConnection.Logger.Errorf("JWT authorization failed: %v", err)
+					return fmt.Errorf("error on trying to check authorization"), "check_authorization_error"
+				}
+			}
+
+			// Check authorization using bbb-web hook
 			numOfAttempts := 0
-			for {
+			for jwtAuthorization == nil {
 				meetingId, userId, errCheckAuthorization = bbb_web.BBBWebCheckAuthorization(browserConnection.Id, sessionToken, clientSessionUUID, browserConnection.BrowserRequestCookies)
 				if errCheckAuthorization != nil {
 					browserConnection.Logger.Error(errCheckAuthorization)
@@ -440,7 +524,11 @@ func connectionInitHandler(browserConnection *common.BrowserConnection) (error,
 			browserConnection.ConnectionInitMessage = fromBrowserMessage
 			browserConnection.Unlock()
 
-			if err, errorId := refreshUserSessionVariables(browserConnection); err != nil {
+			if jwtAuthorization != nil {
+				if err, errorId := setUserSessionVariables(browserConnection, jwtAuthorization.SessionVariables); err != nil {
+					return err, errorId
+				}
+			} else if err, errorId := refreshUserSessionVariables(browserConnection); err != nil {
 				return err, errorId
 			}
 
@@ -459,6 +547,25 @@ func connectionInitHandler(browserConnection *common.BrowserConnection) (error,
 	return nil, ""
 }
 
+// checkJwtAuthorization verifies the token sent in the `connection_init` headers
+func checkJwtAuthorization(headersAsMap map[string]interface{}, sessionToken string) (jwtauth.Authorization, error) {
+	token, existsToken := jwtauth.GetTokenFromHeaders(headersAsMap)
+	if !existsToken {
+		return jwtauth.Authorization{}, fmt.Errorf("token missing on init connection")
+	}
+
+	authorization, err := jwtauth.VerifyToken(token, sessionToken)
+	if err != nil {
+		return authorization, err
+	}
+
+	if authorization.MeetingId == "" || authorization.UserId == "" {
+		return authorization, fmt.Errorf("meetingId or userId missing in token claims")
+	}
+
+	return authorization, nil
+}
+
 func disconnectWithError(
 	browserConnectionWs *websocket.Conn,
 	browserConnectionContext context.Context,
@@ -484,7 +591,7 @@ func disconnectWithError(
 	logger.Tracef("sending to browser: %s", string(jsonData))
 	logger.Infof("deliberately disconnecting browser with error, reason: %s (%s)", reasonMessage, reasonMessageId)
 
-	err := browserConnectionWs.Write(browserConnectionContext, websocket.MessageText, jsonData)
+	err := wsencoding.WriteMessage(browserConnectionContext, browserConnectionWs, jsonData)
 	if err != nil {
 		logger.Debugf("Browser is disconnected, skipping writing of ws message: %v", err)
 	}
@@ -0,0 +1,110 @@
+package websrv
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+
+	"bbb-graphql-middleware/config"
+)
+
+const sameOriginPattern = "same-origin"
+
+// authorizedOrigins contains the config authorized_cross_origins plus the legacy authorized_cross_origin
+var authorizedOrigins = getAuthorizedOrigins()
+
+func getAuthorizedOrigins() []config.OriginPolicy {
+	origins := make([]config.OriginPolicy, 0)
+	for _, originPolicy := range config.GetConfig().Server.AuthorizedCrossOrigins {
+		if originPolicy.Pattern != "" {
+			origins = append(origins, originPolicy)
+		}
+	}
+
+	if legacyOrigin := config.GetConfig().Server.AuthorizedCrossOrigin; legacyOrigin != "" {
+		origins = append(origins, config.OriginPolicy{Pattern: legacyOrigin})
+	}
+
+	return origins
+}
+
+func getAuthorizedOriginPatterns() []string {
+	patterns := make([]string, 0, len(authorizedOrigins))
+	for _, originPolicy := range authorizedOrigins {
+		patterns = append(patterns, originPolicy.Pattern)
+	}
+	return patterns
+}
+
+// findOriginPolicy returns the Origin host of the request and the policy that authorizes it.
+// Requests without Origin or from the same host use the `same-origin` policy (no restrictions).
+// It uses the same matching rules as websocket.Accept (AcceptOptions.OriginPatterns).
+func findOriginPolicy(r *http.Request) (string, config.OriginPolicy, bool) {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return "", config.OriginPolicy{Pattern: sameOriginPattern}, true
+	}
+
+	originUrl, err := url.Parse(origin)
+	if err != nil {
+		return origin, config.OriginPolicy{}, false
+	}
+
+	if strings.EqualFold(r.Host, originUrl.Host) {
+		return originUrl.Host, config.OriginPolicy{Pattern: sameOriginPattern}, true
+	}
+
+	for _, originPolicy := range authorizedOrigins {
+		target := originUrl.Host
+		if strings.Contains(originPolicy.Pattern, "://") {
+			target = originUrl.Scheme + "://" + originUrl.Host
+		}
+		if matched, _ := path.Match(strings.ToLower(originPolicy.Pattern), strings.ToLower(target)); matched {
+			return originUrl.Host, originPolicy, true
+		}
+	}
+
+	return originUrl.Host, config.OriginPolicy{}, false
+}
+
+func isClientTypeAllowedForOrigin(originPolicy config.OriginPolicy, clientType string) bool {
+	if len(originPolicy.AllowedClientTypes) == 0 {
+		return true
+	}
+
+	return slices.ContainsFunc(originPolicy.AllowedClientTypes, func(allowedClientType string) bool {
+		return strings.EqualFold(allowedClientType, clientType)
+	})
+}
+
+// active connections of each origin pattern (to control max_connections of the origin policy)
+var (
+	originConnectionsCount      = make(map[string]int)
+	originConnectionsCountMutex sync.Mutex
+)
+
+// tryAddOriginConnection registers a new connection for the origin, returns false if its limit was reached
+func tryAddOriginConnection(originPolicy config.OriginPolicy) bool {
+	originConnectionsCountMutex.Lock()
+	defer originConnectionsCountMutex.Unlock()
+
+	if originPolicy.MaxConnections > 0 && originConnectionsCount[originPolicy.Pattern] >= originPolicy.MaxConnections {
+		return false
+	}
+
+	originConnectionsCount[originPolicy.Pattern]++
+	return true
+}
+
+func removeOriginConnection(originPolicy config.OriginPolicy) {
+	originConnectionsCountMutex.Lock()
+	defer originConnectionsCountMutex.Unlock()
+
+	originConnectionsCount[originPolicy.Pattern]--
+	if originConnectionsCount[originPolicy.Pattern] <= 0 {
+		delete(originConnectionsCount, originPolicy.Pattern)
+	}
+}
@@ -9,9 +9,13 @@ import (
 	"time"
 
 	"bbb-graphql-middleware/internal/common"
+	"bbb-graphql-middleware/internal/gql_actions"
+	"bbb-graphql-middleware/internal/msgpatch"
 	streamingserver "bbb-graphql-middleware/internal/streaming_server"
+	"bbb-graphql-middleware/internal/wsencoding"
 
 	"github.com/coder/websocket"
+	"github.com/graphql-go/graphql/language/ast"
 )
 
 var streamingHandleByMiddlewarePatterns = [][]byte{
@@ -21,6 +25,9 @@ var streamingHandleByMiddlewarePatterns = [][]byte{
 	[]byte("\"query\":\"subscription getUserVoiceStateStream"),
 }
 
+// Messages without it can't contain a mutation
+var mutationKeyword = []byte("mutation")
+
 func BrowserConnectionReader(
 	browserConnection *common.BrowserConnection,
 	waitGroups []*sync.WaitGroup,
@@ -30,7 +37,9 @@ func BrowserConnectionReader(
 
 	defer func() {
 		browserConnection.FromBrowserToHasuraChannel.Close()
-		browserConnection.FromBrowserToGqlActionsChannel.Close()
+		for _, laneChannel := range browserConnection.FromBrowserToGqlActionsChannels {
+			laneChannel.Close()
+		}
 	}()
 
 	defer func() {
@@ -61,18 +70,31 @@ func BrowserConnectionReader(
 			return
 		}
 
-		browserConnection.Logger.Tracef("received from browser: %s", string(message))
 		browserConnection.Lock()
 		browserConnection.LastBrowserMessageTime = time.Now()
 		browserConnection.Unlock()
 
-		if messageType != websocket.MessageText {
-			browserConnection.Logger.Warnf("received non-text message: %v", messageType)
+		// Messages of the msgpack subprotocol are received as binary and handled as json
+		message, messageTypeSupported, err := wsencoding.DecodeMessage(browserConnection.Websocket, messageType, message)
+		if !messageTypeSupported {
+			browserConnection.Logger.Warnf("received message of unsupported type: %v (subprotocol %s)", messageType, browserConnection.Websocket.Subprotocol())
+			continue
+		}
+		if err != nil {
+			browserConnection.Logger.Errorf("failed to decode message: %v", err)
 			continue
 		}
 
+		browserConnection.Logger.Tracef("received from browser: %s", string(message))
+		common.AddRawBytes(common.WsConnectionBrowser, "received", len(message))
+
 		var browserMessageType struct {
-			Type string `json:"type"`
+			Type    string `json:"type"`
+			ID      string `json:"id"`
+			Payload struct {
+				OperationName string `json:"operationName"`
+				Query         string `json:"query"`
+			} `json:"payload"`
 		}
 		err = json.Unmarshal(message, &browserMessageType)
 		if err != nil {
@@ -80,10 +102,21 @@ func BrowserConnectionReader(
 			continue
 		}
 
+		if browserMessageType.Type == "resync" {
+			// It waits for the subscription message being sent (if any), so it doesn't block reading the next messages
+			go msgpatch.ResendLastData(browserConnection, message)
+			continue
+		}
+
 		if browserMessageType.Type == "subscribe" {
-			if bytes.Contains(message, []byte("\"query\":\"mutation")) {
-				browserConnection.FromBrowserToGqlActionsChannel.SendWait(browserConnection.Context, message)
-				continue
+			// Mutations are sent by GraphqlActionsClient (that applies the mutation limits, interceptors and routes).
+			// Only the messages that may contain a mutation are parsed, the others (and the invalid ones) go to Hasura.
+			if bytes.Contains(message, mutationKeyword) {
+				parsedOperation := common.GetParsedOperation(browserMessageType.Payload.Query, browserMessageType.Payload.OperationName)
+				if parsedOperation.Type == ast.OperationTypeMutation {
+					gql_actions.EnqueueMutation(browserConnection, browserMessageType.ID, parsedOperation.RootFieldName, message)
+					continue
+				}
 			}
 
 			isStreamingSubscription := false
@@ -6,8 +6,10 @@ import (
 	"sync"
 
 	"bbb-graphql-middleware/internal/common"
+	"bbb-graphql-middleware/internal/wsencoding"
 
 	"github.com/coder/websocket"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 func BrowserConnectionWriter(
@@ -34,11 +36,12 @@ RangeLoop:
 				}
 
 				browserConnection.Logger.Tracef("sending to browser: %s", string(toBrowserMessage))
-				err := browserConnection.Websocket.Write(browserConnection.Context, websocket.MessageText, toBrowserMessage)
+				err := wsencoding.WriteMessage(browserConnection.Context, browserConnection.Websocket, toBrowserMessage)
 				if err != nil {
 					browserConnection.Logger.Debugf("Browser is disconnected, skipping writing of ws message: %v", err)
 					return
 				}
+				recordSentBytes(browserConnection, toBrowserMessage)
 
 				// After the error is sent to client, close its connection
 				// Authentication hook unauthorized this request
@@ -56,3 +59,29 @@ RangeLoop:
 		}
 	}
 }
+
+// recordSentBytes counts the size of the message, by operation when the advanced metrics are enabled
+// (the bytes sent through the network are counted by the connection, see wscompression)
+func recordSentBytes(browserConnection *common.BrowserConnection, message []byte) {
+	common.AddRawBytes(common.WsConnectionBrowser, "sent", len(message))
+
+	if !common.PrometheusAdvancedMetricsEnabled {
+		return
+	}
+
+	var messageInfo struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(message, &messageInfo); err != nil || messageInfo.ID == "" {
+		return
+	}
+
+	browserConnection.ActiveSubscriptionsMutex.RLock()
+	subscription, subscriptionExists := browserConnection.ActiveSubscriptions[messageInfo.ID]
+	browserConnection.ActiveSubscriptionsMutex.RUnlock()
+	if !subscriptionExists {
+		return
+	}
+
+	common.GqlSentBytesCounter.With(prometheus.Labels{"operationName": subscription.OperationName}).Add(float64(len(message)))
+}
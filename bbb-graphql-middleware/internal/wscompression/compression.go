@@ -0,0 +1,143 @@
+package wscompression
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"bbb-graphql-middleware/config"
+	"bbb-graphql-middleware/internal/common"
+
+	"github.com/coder/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Compression modes of config server.compression and hasura.compression
+const (
+	ModeDisabled          = "disabled"
+	ModeContextTakeover   = "context_takeover"
+	ModeNoContextTakeover = "no_context_takeover"
+)
+
+func getCompressionMode(mode string) websocket.CompressionMode {
+	switch mode {
+	case ModeContextTakeover:
+		return websocket.CompressionContextTakeover
+	case ModeNoContextTakeover:
+		return websocket.CompressionNoContextTakeover
+	default:
+		return websocket.CompressionDisabled
+	}
+}
+
+// SetAcceptOptions sets the compression of the browser connections (config server.compression)
+func SetAcceptOptions(acceptOptions *websocket.AcceptOptions) {
+	compressionConfig := config.GetConfig().Server.Compression
+	acceptOptions.CompressionMode = getCompressionMode(compressionConfig.Mode)
+	acceptOptions.CompressionThreshold = compressionConfig.Threshold
+}
+
+// SetDialOptions sets the compression of the connections to Hasura (config hasura.compression)
+func SetDialOptions(dialOptions *websocket.DialOptions) {
+	compressionConfig := config.GetConfig().Hasura.Compression
+	dialOptions.CompressionMode = getCompressionMode(compressionConfig.Mode)
+	dialOptions.CompressionThreshold = compressionConfig.Threshold
+}
+
+// RecordNegotiation records whether the peer accepted the compression (by the header Sec-WebSocket-Extensions
+// of the handshake response), when it's enabled in config. It returns true when the compression is used.
+func RecordNegotiation(connection string, compressionMode string, responseHeader http.Header) bool {
+	if getCompressionMode(compressionMode) == websocket.CompressionDisabled {
+		return false
+	}
+
+	negotiated := strings.Contains(responseHeader.Get("Sec-WebSocket-Extensions"), "permessage-deflate")
+	result := "not_negotiated"
+	if negotiated {
+		result = "negotiated"
+	}
+	common.WsCompressionCounter.With(prometheus.Labels{"connection": connection, "result": result}).Inc()
+	return negotiated
+}
+
+// countingConn counts the bytes written to and read from the network
+type countingConn struct {
+	net.Conn
+	counter *common.WireBytesCounter
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.counter.AddReceived(n)
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.counter.AddSent(n)
+	return n, err
+}
+
+// countingResponseWriter makes websocket.Accept use a connection that counts its bytes
+type countingResponseWriter struct {
+	http.ResponseWriter
+	counter *common.WireBytesCounter
+}
+
+// NewCountingResponseWriter wraps the ResponseWriter of the browser connection, so the hijacked connection
+// counts the bytes sent and received
+func NewCountingResponseWriter(w http.ResponseWriter, counter *common.WireBytesCounter) http.ResponseWriter {
+	return &countingResponseWriter{ResponseWriter: w, counter: counter}
+}
+
+func (w *countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("http.ResponseWriter does not implement http.Hijacker")
+	}
+
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	wrappedConn := &countingConn{Conn: conn, counter: w.counter}
+
+	// The buffered reader is reset by websocket.Accept to read from the returned connection,
+	// but the writer has to be reset here (it's empty after flushing the pending data)
+	if err := brw.Writer.Flush(); err != nil {
+		return nil, nil, err
+	}
+	brw.Writer.Reset(wrappedConn)
+
+	return wrappedConn, brw, nil
+}
+
+func (w *countingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// NewCountingTransport creates the transport of the connections to Hasura, that count their bytes
+// (it's shared by all the connections, so its idle connections are reused)
+func NewCountingTransport(counter *common.WireBytesCounter) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return &countingConn{Conn: conn, counter: counter}, nil
+		},
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+}
@@ -0,0 +1,164 @@
+package wsencoding
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"bbb-graphql-middleware/config"
+
+	"github.com/coder/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Websocket subprotocols offered to the browser, both carry the same messages (graphql-transport-ws),
+// the msgpack one encodes them using MessagePack (binary frames)
+const (
+	SubprotocolJson    = "graphql-transport-ws"
+	SubprotocolMsgpack = "graphql-transport-ws+msgpack"
+)
+
+// GetSubprotocols returns the subprotocols offered to the browser, msgpack first as the clients offering it prefer it
+func GetSubprotocols() []string {
+	if config.GetConfig().Server.MsgpackSubprotocolDisabled {
+		return []string{SubprotocolJson}
+	}
+	return []string{SubprotocolMsgpack, SubprotocolJson}
+}
+
+// IsMsgpack returns whether the connection uses the msgpack subprotocol
+func IsMsgpack(conn *websocket.Conn) bool {
+	return conn.Subprotocol() == SubprotocolMsgpack
+}
+
+// WriteMessage sends the json message to the browser, encoded according to the subprotocol of the connection
+func WriteMessage(ctx context.Context, conn *websocket.Conn, message []byte) error {
+	if !IsMsgpack(conn) {
+		return conn.Write(ctx, websocket.MessageText, message)
+	}
+
+	msgpackMessage, err := JsonToMsgpack(message)
+	if err != nil {
+		return fmt.Errorf("failed to encode message as msgpack: %w", err)
+	}
+	return conn.Write(ctx, websocket.MessageBinary, msgpackMessage)
+}
+
+// DecodeMessage returns the json of a message received from the browser (false when the frame type
+// is not the one of the subprotocol: text for json and binary for msgpack)
+func DecodeMessage(conn *websocket.Conn, messageType websocket.MessageType, message []byte) ([]byte, bool, error) {
+	if !IsMsgpack(conn) {
+		return message, messageType == websocket.MessageText, nil
+	}
+
+	if messageType != websocket.MessageBinary {
+		return nil, false, nil
+	}
+
+	jsonMessage, err := MsgpackToJson(message)
+	if err != nil {
+		return nil, true, fmt.Errorf("failed to decode msgpack message: %w", err)
+	}
+	return jsonMessage, true, nil
+}
+
+// JsonToMsgpack transcodes a json message to msgpack (integers are kept as integers)
+func JsonToMsgpack(jsonMessage []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(jsonMessage))
+	decoder.UseNumber()
+
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+
+	return msgpack.Marshal(convertJsonNumbers(value))
+}
+
+// MsgpackToJson transcodes a msgpack message to json
+func MsgpackToJson(msgpackMessage []byte) ([]byte, error) {
+	decoder := msgpack.NewDecoder(bytes.NewReader(msgpackMessage))
+	decoder.SetMapDecoder(func(d *msgpack.Decoder) (interface{}, error) {
+		return d.DecodeUntypedMap()
+	})
+
+	value, err := decoder.DecodeInterface()
+	if err != nil {
+		return nil, err
+	}
+
+	jsonValue, err := convertMsgpackMaps(value)
+	if err != nil {
+		return nil, err
+	}
+
+	// The queries are kept as received (without escaping <, > and &)
+	var jsonMessage bytes.Buffer
+	encoder := json.NewEncoder(&jsonMessage)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(jsonValue); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(jsonMessage.Bytes(), []byte("\n")), nil
+}
+
+// convertJsonNumbers replaces the json.Number values by int64, uint64 for the positive integers above MaxInt64
+// (or float64 when it's not an integer supported by msgpack)
+func convertJsonNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if intValue, err := v.Int64(); err == nil {
+			return intValue
+		}
+		if uintValue, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+			return uintValue
+		}
+		floatValue, _ := v.Float64()
+		return floatValue
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = convertJsonNumbers(item)
+		}
+		return v
+	case []interface{}:
+		for i, item := range v {
+			v[i] = convertJsonNumbers(item)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// convertMsgpackMaps replaces the maps decoded from msgpack by maps with string keys (the only ones supported by json)
+func convertMsgpackMaps(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		jsonMap := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			keyAsString, isString := key.(string)
+			if !isString {
+				return nil, fmt.Errorf("map key %v is not a string", key)
+			}
+			jsonItem, err := convertMsgpackMaps(item)
+			if err != nil {
+				return nil, err
+			}
+			jsonMap[keyAsString] = jsonItem
+		}
+		return jsonMap, nil
+	case []interface{}:
+		for i, item := range v {
+			jsonItem, err := convertMsgpackMaps(item)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = jsonItem
+		}
+		return v, nil
+	default:
+		return v, nil
+	}
+}